@@ -17,12 +17,15 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/config"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/server"
 )
 
@@ -67,6 +70,12 @@ func main() {
 				log.Fatalf("failed to load configuration: %v", err)
 			}
 
+			logger, err := logging.New(os.Stderr, cfg.LogLevel, cfg.LogFormat)
+			if err != nil {
+				log.Fatalf("failed to configure logging: %v", err)
+			}
+			slog.SetDefault(logger)
+
 			server.Run(cfg)
 		},
 	}
@@ -76,9 +85,36 @@ func main() {
 	root.Flags().String("sakura-api-secret", "", "SakuraCloud API secret")
 	root.Flags().String("provider-ip", "0.0.0.0", "Webhook listen host")
 	root.Flags().String("provider-port", "8080", "Webhook listen port")
+	root.Flags().String("health-ip", "0.0.0.0", "Health and metrics listen host")
+	root.Flags().String("health-port", "", "Health and metrics listen port; empty serves them on the webhook port")
+	root.Flags().Duration("readiness-max-age", 30*time.Second, "How long /readyz trusts the last SakuraCloud API outcome before reading the zone")
 	root.Flags().Bool("registry-txt", false, "Enable TXT registry mode")
 	root.Flags().String("txt-owner-id", "default", "TXT owner ID for registry mode")
+	root.Flags().String("txt-prefix", "", "TXT registry name prefix; may contain %{record_type} (mutually exclusive with --txt-suffix; defaults to _external-dns. when neither is set)")
+	root.Flags().String("txt-suffix", "", "TXT registry name suffix; may contain %{record_type} (mutually exclusive with --txt-prefix)")
+	root.Flags().String("txt-wildcard-replacement", "", "Replacement for a leading '*' label in TXT registry names")
 	root.Flags().String("zone-name", "", "DNS zone name")
+	root.Flags().StringSlice("zone-names", nil, "Comma-separated list of DNS zone names")
+	root.Flags().Duration("records-cache-ttl", 0, "How long GET /records serves a zone from memory; 0 disables the cache")
+	root.Flags().Duration("stale-records-window", 0, "Serve the last zone snapshot on GET /records during API errors, up to this age; 0 disables")
+	root.Flags().Duration("api-timeout", 30*time.Second, "Timeout of a single SakuraCloud API request")
+	root.Flags().Float64("api-rate-limit", 5, "Sustained SakuraCloud API calls per second")
+	root.Flags().Int("api-burst", 10, "SakuraCloud API calls allowed at once above --api-rate-limit")
+	root.Flags().Int("api-max-retries", 4, "Retries of SakuraCloud API calls failing with 429, 5xx or a timeout")
+	root.Flags().Duration("api-retry-base-delay", 500*time.Millisecond, "Backoff of the first SakuraCloud API retry; doubles per attempt")
+	root.Flags().Duration("api-retry-max-delay", 30*time.Second, "Maximum backoff between SakuraCloud API retries, also capping Retry-After")
+	root.Flags().Duration("request-timeout", 60*time.Second, "How long a webhook request may wait for the apply queue and SakuraCloud API retries")
+	root.Flags().Duration("shutdown-timeout", 30*time.Second, "How long in-flight requests may drain after SIGTERM or SIGINT")
+	root.Flags().Bool("dry-run", false, "Log planned zone changes without updating SakuraCloud")
+	root.Flags().Int("max-deletions", 0, "Refuse zone updates deleting more records than this; 0 disables")
+	root.Flags().Float64("max-deletion-percent", 0, "Refuse zone updates deleting more than this percentage of the zone; 0 disables")
+	root.Flags().Bool("allow-mass-deletion", false, "Apply zone updates above the deletion limits anyway")
+	root.Flags().StringArray("protect-records", nil, "[TYPE:]PATTERN rule of records never modified, e.g. MX:@; repeat the flag for more rules")
+	root.Flags().Bool("hide-protected-records", false, "Leave protected records out of GET /records")
+	root.Flags().Bool("apex-cname-alias", false, "Create CNAME endpoints at a zone apex as ALIAS records instead of refusing them")
+	root.Flags().String("log-level", "info", "Log level: debug, info, warn or error")
+	root.Flags().String("log-format", "text", "Log format: text or json")
+	root.Flags().String("otlp-endpoint", "", "OTLP/HTTP endpoint to export traces to, e.g. http://otel-collector:4318")
 
 	if err := viper.BindPFlag("sakura-api-token", root.Flags().Lookup("sakura-api-token")); err != nil {
 		log.Fatalf("failed to bind --sakura-api-token flag: %v", err)
@@ -92,15 +128,96 @@ func main() {
 	if err := viper.BindPFlag("provider-port", root.Flags().Lookup("provider-port")); err != nil {
 		log.Fatalf("failed to bind --provider-port flag: %v", err)
 	}
+	if err := viper.BindPFlag("health-ip", root.Flags().Lookup("health-ip")); err != nil {
+		log.Fatalf("failed to bind --health-ip flag: %v", err)
+	}
+	if err := viper.BindPFlag("health-port", root.Flags().Lookup("health-port")); err != nil {
+		log.Fatalf("failed to bind --health-port flag: %v", err)
+	}
+	if err := viper.BindPFlag("readiness-max-age", root.Flags().Lookup("readiness-max-age")); err != nil {
+		log.Fatalf("failed to bind --readiness-max-age flag: %v", err)
+	}
 	if err := viper.BindPFlag("registry-txt", root.Flags().Lookup("registry-txt")); err != nil {
 		log.Fatalf("failed to bind --registry-txt flag: %v", err)
 	}
 	if err := viper.BindPFlag("txt-owner-id", root.Flags().Lookup("txt-owner-id")); err != nil {
 		log.Fatalf("failed to bind --txt-owner-id flag: %v", err)
 	}
+	if err := viper.BindPFlag("txt-prefix", root.Flags().Lookup("txt-prefix")); err != nil {
+		log.Fatalf("failed to bind --txt-prefix flag: %v", err)
+	}
+	if err := viper.BindPFlag("txt-suffix", root.Flags().Lookup("txt-suffix")); err != nil {
+		log.Fatalf("failed to bind --txt-suffix flag: %v", err)
+	}
+	if err := viper.BindPFlag("txt-wildcard-replacement", root.Flags().Lookup("txt-wildcard-replacement")); err != nil {
+		log.Fatalf("failed to bind --txt-wildcard-replacement flag: %v", err)
+	}
 	if err := viper.BindPFlag("zone-name", root.Flags().Lookup("zone-name")); err != nil {
 		log.Fatalf("failed to bind --zone-name flag: %v", err)
 	}
+	if err := viper.BindPFlag("zone-names", root.Flags().Lookup("zone-names")); err != nil {
+		log.Fatalf("failed to bind --zone-names flag: %v", err)
+	}
+	if err := viper.BindPFlag("records-cache-ttl", root.Flags().Lookup("records-cache-ttl")); err != nil {
+		log.Fatalf("failed to bind --records-cache-ttl flag: %v", err)
+	}
+	if err := viper.BindPFlag("stale-records-window", root.Flags().Lookup("stale-records-window")); err != nil {
+		log.Fatalf("failed to bind --stale-records-window flag: %v", err)
+	}
+	if err := viper.BindPFlag("api-timeout", root.Flags().Lookup("api-timeout")); err != nil {
+		log.Fatalf("failed to bind --api-timeout flag: %v", err)
+	}
+	if err := viper.BindPFlag("api-rate-limit", root.Flags().Lookup("api-rate-limit")); err != nil {
+		log.Fatalf("failed to bind --api-rate-limit flag: %v", err)
+	}
+	if err := viper.BindPFlag("api-burst", root.Flags().Lookup("api-burst")); err != nil {
+		log.Fatalf("failed to bind --api-burst flag: %v", err)
+	}
+	if err := viper.BindPFlag("api-max-retries", root.Flags().Lookup("api-max-retries")); err != nil {
+		log.Fatalf("failed to bind --api-max-retries flag: %v", err)
+	}
+	if err := viper.BindPFlag("api-retry-base-delay", root.Flags().Lookup("api-retry-base-delay")); err != nil {
+		log.Fatalf("failed to bind --api-retry-base-delay flag: %v", err)
+	}
+	if err := viper.BindPFlag("api-retry-max-delay", root.Flags().Lookup("api-retry-max-delay")); err != nil {
+		log.Fatalf("failed to bind --api-retry-max-delay flag: %v", err)
+	}
+	if err := viper.BindPFlag("request-timeout", root.Flags().Lookup("request-timeout")); err != nil {
+		log.Fatalf("failed to bind --request-timeout flag: %v", err)
+	}
+	if err := viper.BindPFlag("shutdown-timeout", root.Flags().Lookup("shutdown-timeout")); err != nil {
+		log.Fatalf("failed to bind --shutdown-timeout flag: %v", err)
+	}
+	if err := viper.BindPFlag("dry-run", root.Flags().Lookup("dry-run")); err != nil {
+		log.Fatalf("failed to bind --dry-run flag: %v", err)
+	}
+	if err := viper.BindPFlag("max-deletions", root.Flags().Lookup("max-deletions")); err != nil {
+		log.Fatalf("failed to bind --max-deletions flag: %v", err)
+	}
+	if err := viper.BindPFlag("max-deletion-percent", root.Flags().Lookup("max-deletion-percent")); err != nil {
+		log.Fatalf("failed to bind --max-deletion-percent flag: %v", err)
+	}
+	if err := viper.BindPFlag("allow-mass-deletion", root.Flags().Lookup("allow-mass-deletion")); err != nil {
+		log.Fatalf("failed to bind --allow-mass-deletion flag: %v", err)
+	}
+	if err := viper.BindPFlag("protect-records", root.Flags().Lookup("protect-records")); err != nil {
+		log.Fatalf("failed to bind --protect-records flag: %v", err)
+	}
+	if err := viper.BindPFlag("hide-protected-records", root.Flags().Lookup("hide-protected-records")); err != nil {
+		log.Fatalf("failed to bind --hide-protected-records flag: %v", err)
+	}
+	if err := viper.BindPFlag("apex-cname-alias", root.Flags().Lookup("apex-cname-alias")); err != nil {
+		log.Fatalf("failed to bind --apex-cname-alias flag: %v", err)
+	}
+	if err := viper.BindPFlag("log-level", root.Flags().Lookup("log-level")); err != nil {
+		log.Fatalf("failed to bind --log-level flag: %v", err)
+	}
+	if err := viper.BindPFlag("log-format", root.Flags().Lookup("log-format")); err != nil {
+		log.Fatalf("failed to bind --log-format flag: %v", err)
+	}
+	if err := viper.BindPFlag("otlp-endpoint", root.Flags().Lookup("otlp-endpoint")); err != nil {
+		log.Fatalf("failed to bind --otlp-endpoint flag: %v", err)
+	}
 
 	if err := viper.BindEnv("sakura-api-token", "WEBHOOK_SAKURA_API_TOKEN"); err != nil {
 		log.Fatalf("failed to bind env WEBHOOK_SAKURA_API_TOKEN: %v", err)
@@ -114,15 +231,96 @@ func main() {
 	if err := viper.BindEnv("provider-port", "WEBHOOK_PROVIDER_PORT"); err != nil {
 		log.Fatalf("failed to bind env WEBHOOK_PROVIDER_PORT: %v", err)
 	}
+	if err := viper.BindEnv("health-ip", "WEBHOOK_HEALTH_IP"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_HEALTH_IP: %v", err)
+	}
+	if err := viper.BindEnv("health-port", "WEBHOOK_HEALTH_PORT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_HEALTH_PORT: %v", err)
+	}
+	if err := viper.BindEnv("readiness-max-age", "WEBHOOK_READINESS_MAX_AGE"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_READINESS_MAX_AGE: %v", err)
+	}
 	if err := viper.BindEnv("registry-txt", "WEBHOOK_REGISTRY_TXT"); err != nil {
 		log.Fatalf("failed to bind env WEBHOOK_REGISTRY_TXT: %v", err)
 	}
 	if err := viper.BindEnv("txt-owner-id", "WEBHOOK_TXT_OWNER_ID"); err != nil {
 		log.Fatalf("failed to bind env WEBHOOK_TXT_OWNER_ID: %v", err)
 	}
+	if err := viper.BindEnv("txt-prefix", "WEBHOOK_TXT_PREFIX"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_TXT_PREFIX: %v", err)
+	}
+	if err := viper.BindEnv("txt-suffix", "WEBHOOK_TXT_SUFFIX"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_TXT_SUFFIX: %v", err)
+	}
+	if err := viper.BindEnv("txt-wildcard-replacement", "WEBHOOK_TXT_WILDCARD_REPLACEMENT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_TXT_WILDCARD_REPLACEMENT: %v", err)
+	}
 	if err := viper.BindEnv("zone-name", "WEBHOOK_ZONE_NAME"); err != nil {
 		log.Fatalf("failed to bind env WEBHOOK_ZONE_NAME: %v", err)
 	}
+	if err := viper.BindEnv("zone-names", "WEBHOOK_ZONE_NAMES"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_ZONE_NAMES: %v", err)
+	}
+	if err := viper.BindEnv("records-cache-ttl", "WEBHOOK_RECORDS_CACHE_TTL"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_RECORDS_CACHE_TTL: %v", err)
+	}
+	if err := viper.BindEnv("stale-records-window", "WEBHOOK_STALE_RECORDS_WINDOW"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_STALE_RECORDS_WINDOW: %v", err)
+	}
+	if err := viper.BindEnv("api-timeout", "WEBHOOK_API_TIMEOUT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_API_TIMEOUT: %v", err)
+	}
+	if err := viper.BindEnv("api-rate-limit", "WEBHOOK_API_RATE_LIMIT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_API_RATE_LIMIT: %v", err)
+	}
+	if err := viper.BindEnv("api-burst", "WEBHOOK_API_BURST"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_API_BURST: %v", err)
+	}
+	if err := viper.BindEnv("api-max-retries", "WEBHOOK_API_MAX_RETRIES"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_API_MAX_RETRIES: %v", err)
+	}
+	if err := viper.BindEnv("api-retry-base-delay", "WEBHOOK_API_RETRY_BASE_DELAY"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_API_RETRY_BASE_DELAY: %v", err)
+	}
+	if err := viper.BindEnv("api-retry-max-delay", "WEBHOOK_API_RETRY_MAX_DELAY"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_API_RETRY_MAX_DELAY: %v", err)
+	}
+	if err := viper.BindEnv("request-timeout", "WEBHOOK_REQUEST_TIMEOUT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_REQUEST_TIMEOUT: %v", err)
+	}
+	if err := viper.BindEnv("shutdown-timeout", "WEBHOOK_SHUTDOWN_TIMEOUT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_SHUTDOWN_TIMEOUT: %v", err)
+	}
+	if err := viper.BindEnv("dry-run", "WEBHOOK_DRY_RUN"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_DRY_RUN: %v", err)
+	}
+	if err := viper.BindEnv("max-deletions", "WEBHOOK_MAX_DELETIONS"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_MAX_DELETIONS: %v", err)
+	}
+	if err := viper.BindEnv("max-deletion-percent", "WEBHOOK_MAX_DELETION_PERCENT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_MAX_DELETION_PERCENT: %v", err)
+	}
+	if err := viper.BindEnv("allow-mass-deletion", "WEBHOOK_ALLOW_MASS_DELETION"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_ALLOW_MASS_DELETION: %v", err)
+	}
+	if err := viper.BindEnv("protect-records", "WEBHOOK_PROTECT_RECORDS"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_PROTECT_RECORDS: %v", err)
+	}
+	if err := viper.BindEnv("hide-protected-records", "WEBHOOK_HIDE_PROTECTED_RECORDS"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_HIDE_PROTECTED_RECORDS: %v", err)
+	}
+	if err := viper.BindEnv("apex-cname-alias", "WEBHOOK_APEX_CNAME_ALIAS"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_APEX_CNAME_ALIAS: %v", err)
+	}
+	if err := viper.BindEnv("log-level", "WEBHOOK_LOG_LEVEL"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_LOG_LEVEL: %v", err)
+	}
+	if err := viper.BindEnv("log-format", "WEBHOOK_LOG_FORMAT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_LOG_FORMAT: %v", err)
+	}
+	if err := viper.BindEnv("otlp-endpoint", "WEBHOOK_OTLP_ENDPOINT"); err != nil {
+		log.Fatalf("failed to bind env WEBHOOK_OTLP_ENDPOINT: %v", err)
+	}
 
 	if err := root.Execute(); err != nil {
 		log.Fatalf("command execution failed: %v", err)
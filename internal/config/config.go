@@ -14,12 +14,90 @@
 
 package config
 
+import (
+	"strings"
+	"time"
+)
+
 type Config struct {
-    SakuraApiToken string `mapstructure:"sakura-api-token"`
-    SakuraApiSecret string `mapstructure:"sakura-api-secret"`
-    ProviderIP string `mapstructure:"provider-ip"`
-    ProviderPort string `mapstructure:"provider-port"`
-    ZoneName string `mapstructure:"zone-name"`
-    RegistryTXT bool `mapstructure:"registry-txt"`
-    TxtOwnerID  string `mapstructure:"txt-owner-id"`
+	SakuraApiToken  string   `mapstructure:"sakura-api-token"`
+	SakuraApiSecret string   `mapstructure:"sakura-api-secret"`
+	ProviderIP      string   `mapstructure:"provider-ip"`
+	ProviderPort    string   `mapstructure:"provider-port"`
+	ZoneName        string   `mapstructure:"zone-name"`
+	ZoneNames       []string `mapstructure:"zone-names"`
+	RegistryTXT     bool     `mapstructure:"registry-txt"`
+	TxtOwnerID      string   `mapstructure:"txt-owner-id"`
+	// TXT registry naming, with the same semantics as external-dns
+	// --txt-prefix, --txt-suffix and --txt-wildcard-replacement.
+	TxtPrefix              string `mapstructure:"txt-prefix"`
+	TxtSuffix              string `mapstructure:"txt-suffix"`
+	TxtWildcardReplacement string `mapstructure:"txt-wildcard-replacement"`
+	// HealthIP and HealthPort configure a separate listener for /healthz,
+	// /readyz and /metrics; it is disabled while HealthPort is empty.
+	HealthIP   string `mapstructure:"health-ip"`
+	HealthPort string `mapstructure:"health-port"`
+	// ReadinessMaxAge is how long /readyz trusts the last SakuraCloud API
+	// outcome of a zone before reading the zone itself.
+	ReadinessMaxAge time.Duration `mapstructure:"readiness-max-age"`
+	// RecordsCacheTTL is how long GET /records serves a zone from memory;
+	// zero disables the cache.
+	RecordsCacheTTL time.Duration `mapstructure:"records-cache-ttl"`
+	// StaleRecordsWindow lets GET /records serve the last snapshot of a zone
+	// that cannot be read, up to this age; zero disables stale serving.
+	StaleRecordsWindow time.Duration `mapstructure:"stale-records-window"`
+	// SakuraCloud API client settings; see provider.APIOptions. Zero values
+	// fall back to the provider defaults.
+	ApiTimeout        time.Duration `mapstructure:"api-timeout"`
+	ApiRateLimit      float64       `mapstructure:"api-rate-limit"`
+	ApiBurst          int           `mapstructure:"api-burst"`
+	ApiMaxRetries     int           `mapstructure:"api-max-retries"`
+	ApiRetryBaseDelay time.Duration `mapstructure:"api-retry-base-delay"`
+	ApiRetryMaxDelay  time.Duration `mapstructure:"api-retry-max-delay"`
+	// RequestTimeout bounds how long a webhook request may wait for the apply
+	// queue and retry SakuraCloud API calls; the write timeout of the webhook
+	// listener is derived from it and ApiTimeout.
+	RequestTimeout time.Duration `mapstructure:"request-timeout"`
+	// ShutdownTimeout bounds how long in-flight requests may drain after
+	// SIGTERM or SIGINT.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown-timeout"`
+	// DryRun computes and logs zone changes without updating SakuraCloud.
+	DryRun bool `mapstructure:"dry-run"`
+	// ApexCNAMEAlias creates CNAME endpoints at a zone apex as ALIAS records;
+	// when false they are refused.
+	ApexCNAMEAlias bool `mapstructure:"apex-cname-alias"`
+	// MaxDeletions and MaxDeletionPercent refuse zone updates deleting more
+	// records, or a larger share of the zone; zero disables a limit.
+	// AllowMassDeletion applies such updates anyway.
+	MaxDeletions       int     `mapstructure:"max-deletions"`
+	MaxDeletionPercent float64 `mapstructure:"max-deletion-percent"`
+	AllowMassDeletion  bool    `mapstructure:"allow-mass-deletion"`
+	// ProtectRecords lists "[TYPE:]PATTERN" rules of records the webhook
+	// never modifies; see provider.ParseProtectRule. HideProtectedRecords
+	// also leaves them out of GET /records.
+	ProtectRecords       []string `mapstructure:"protect-records"`
+	HideProtectedRecords bool     `mapstructure:"hide-protected-records"`
+	// LogLevel is one of debug, info, warn or error; LogFormat is text or json.
+	LogLevel  string `mapstructure:"log-level"`
+	LogFormat string `mapstructure:"log-format"`
+	// OtlpEndpoint is the OTLP/HTTP collector URL traces are exported to;
+	// tracing is disabled while it is empty.
+	OtlpEndpoint string `mapstructure:"otlp-endpoint"`
+}
+
+// Zones returns every zone the webhook should manage.
+// ZoneName is kept for backward compatibility and is merged with ZoneNames;
+// names are lower-cased, stripped of a trailing dot and de-duplicated.
+func (c Config) Zones() []string {
+	var zones []string
+	seen := map[string]bool{}
+	for _, z := range append([]string{c.ZoneName}, c.ZoneNames...) {
+		z = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(z), "."))
+		if z == "" || seen[z] {
+			continue
+		}
+		seen[z] = true
+		zones = append(zones, z)
+	}
+	return zones
 }
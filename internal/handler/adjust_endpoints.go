@@ -16,46 +16,89 @@ package handler
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
 
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/registry"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/tracing"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
 // AdjustHandler handles POST /adjustendpoints requests.
 // It accepts the desired endpoint set from controller, applies optional
 // filtering or ownership logic, and returns the final endpoint set.
-func AdjustHandler(client Provider) http.HandlerFunc {
+//
+// When reg enforces ownership, desired endpoints whose names are owned by
+// another owner ID in the zone's TXT registry are dropped, so the controller
+// never plans changes against them.
+//
+// A CNAME at a zone apex gets the "alias=true" property when
+// zones.AliasApexCNAME is on, and is dropped otherwise.
+func AdjustHandler(zones *Zones, reg *registry.Registry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[AdjustHandler] POST /adjustendpoints invoked")
+		ctx, span := tracer.Start(r.Context(), "AdjustHandler")
+		defer span.End()
+		logger := logging.FromContext(ctx)
+		logger.Info("adjust endpoints invoked")
 
 		if ct := r.Header.Get("Content-Type"); ct != "application/external.dns.webhook+json;version=1" {
-			log.Printf("[AdjustHandler] invalid Content-Type: %s", ct)
+			logger.Warn("invalid content type", "content_type", ct)
 			http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
 			return
 		}
 
 		var desired []*endpoint.Endpoint
 		if err := json.NewDecoder(r.Body).Decode(&desired); err != nil {
-			log.Printf("[AdjustHandler] error decoding payload: %v", err)
+			logger.Warn("failed to decode payload", logging.KeyError, err)
 			http.Error(w, "failed to decode desired endpoints", http.StatusBadRequest)
 			return
 		}
-		log.Printf("[AdjustHandler] received %d desired endpoints", len(desired))
+		logger.Debug("received desired endpoints", "count", len(desired))
 
-		// Optionally, implement TXT registry filtering here (owner-id logic)
-		// For now, we just pass through all desired endpoints
-		adjusted := desired
+		adjusted := zones.adjustApexCNAMEs(ctx, desired)
+		if reg.Enforced() {
+			candidates := adjusted
+			adjusted = []*endpoint.Endpoint{}
+			ownersByZone := map[string]registry.Owners{}
+			for _, ep := range candidates {
+				if ep == nil {
+					continue
+				}
+				zone, ok := zones.Match(ep.DNSName)
+				if !ok {
+					adjusted = append(adjusted, ep)
+					continue
+				}
+				owners, ok := ownersByZone[zone]
+				if !ok {
+					var err error
+					owners, err = zoneOwners(ctx, zones.Provider(zone), zone, reg)
+					if err != nil {
+						logger.Error("failed to read registry owners", logging.KeyZone, zone, logging.KeyError, err)
+						tracing.RecordError(span, err)
+						http.Error(w, "failed to read TXT registry", http.StatusInternalServerError)
+						return
+					}
+					ownersByZone[zone] = owners
+				}
+				if conflicts := reg.Check([]*endpoint.Endpoint{ep}, owners); len(conflicts) > 0 {
+					logger.Info("dropping endpoint owned by another owner",
+						logging.KeyZone, zone, logging.KeyRecordName, ep.DNSName, logging.KeyRecordType, ep.RecordType)
+					continue
+				}
+				adjusted = append(adjusted, ep)
+			}
+		}
 
 		w.Header().Set(
 			"Content-Type",
 			"application/external.dns.webhook+json;version=1",
 		)
 		if err := json.NewEncoder(w).Encode(adjusted); err != nil {
-			log.Printf("[AdjustHandler] error encoding response: %v", err)
+			logger.Error("failed to encode response", logging.KeyError, err)
 			http.Error(w, "failed to encode adjusted endpoints", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("[AdjustHandler] returned %d endpoints", len(adjusted))
+		logger.Info("returned adjusted endpoints", "count", len(adjusted))
 	}
 }
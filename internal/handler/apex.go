@@ -0,0 +1,98 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"errors"
+
+	"sigs.k8s.io/external-dns/endpoint"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+)
+
+// ErrApexCNAME is the problem reported for a CNAME endpoint at a zone apex while
+// Zones.AliasApexCNAME is off; DNS does not allow a CNAME there.
+var ErrApexCNAME = errors.New("CNAME is not allowed at the zone apex")
+
+// isAlias reports whether e carries the "alias=true" provider-specific
+// property that turns a CNAME endpoint into a SakuraCloud ALIAS record.
+func isAlias(e *endpoint.Endpoint) bool {
+	for _, ps := range e.ProviderSpecific {
+		if ps.Name == "alias" && ps.Value == "true" {
+			return true
+		}
+	}
+	return false
+}
+
+// apexCNAMEs applies the apex CNAME policy to the endpoints of zone.
+//
+// When AliasApexCNAME is on, a plain CNAME at the apex is returned as a copy
+// with "alias=true", which convertEndpoints turns into an ALIAS record and
+// GET /records reports back the same way. Otherwise such an endpoint is
+// left out and reported with ErrApexCNAME in a *provider.ValidationError.
+// Other endpoints are returned unchanged.
+func (z *Zones) apexCNAMEs(ctx context.Context, zone string, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	out := make([]*endpoint.Endpoint, 0, len(endpoints))
+	var problems []provider.Problem
+	for _, e := range endpoints {
+		if e == nil || e.RecordType != endpoint.RecordTypeCNAME || isAlias(e) ||
+			provider.RelativeName(e.DNSName, zone) != provider.ApexName {
+			out = append(out, e)
+			continue
+		}
+		if !z.AliasApexCNAME {
+			problems = append(problems, provider.Problem{DNSName: provider.FQDN(provider.ApexName, zone), RecordType: e.RecordType, Reason: ErrApexCNAME.Error()})
+			continue
+		}
+
+		logging.FromContext(ctx).Debug("substituting ALIAS for apex CNAME",
+			logging.KeyZone, zone, logging.KeyRecordName, e.DNSName)
+		alias := *e
+		alias.ProviderSpecific = append(endpoint.ProviderSpecific{{Name: "alias", Value: "true"}}, e.ProviderSpecific...)
+		out = append(out, &alias)
+	}
+	if len(problems) > 0 {
+		return out, &provider.ValidationError{Zone: zone, Problems: problems}
+	}
+	return out, nil
+}
+
+// adjustApexCNAMEs applies the apex CNAME policy to the desired endpoints of
+// POST /adjustendpoints, so that the plan already carries the ALIAS flag
+// GET /records reports, or never contains an apex CNAME that would be refused.
+func (z *Zones) adjustApexCNAMEs(ctx context.Context, desired []*endpoint.Endpoint) []*endpoint.Endpoint {
+	adjusted := make([]*endpoint.Endpoint, 0, len(desired))
+	for _, e := range desired {
+		if e == nil {
+			adjusted = append(adjusted, e)
+			continue
+		}
+		zone, ok := z.Match(e.DNSName)
+		if !ok {
+			adjusted = append(adjusted, e)
+			continue
+		}
+		eps, err := z.apexCNAMEs(ctx, zone, []*endpoint.Endpoint{e})
+		if err != nil {
+			logging.FromContext(ctx).Warn("dropping endpoint", logging.KeyZone, zone, logging.KeyError, err)
+			continue
+		}
+		adjusted = append(adjusted, eps...)
+	}
+	return adjusted
+}
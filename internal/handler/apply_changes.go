@@ -15,13 +15,21 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/netip"
 	"strings"
 
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/registry"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
@@ -39,53 +47,56 @@ type ChangeRequest struct {
 	UpdateNew []*endpoint.Endpoint `json:"updateNew"`
 }
 
-// safeTrimZoneSuffix trims the zone suffix only if the name actually ends
-// with the given zone suffix. It also drops a trailing dot if any.
-//
-// This prevents accidental over-trimming when the input name does not belong
-// to the current zone (or already came in relative form).
-func safeTrimZoneSuffix(name, zoneSuffix string) string {
-	if zoneSuffix != "" && strings.HasSuffix(name, zoneSuffix) {
-		name = strings.TrimSuffix(name, zoneSuffix)
-	}
-	// Normalize trailing dot for safety (relative record names must not end with ".")
-	return strings.TrimSuffix(name, ".")
-}
-
 // convertEndpoints converts []*endpoint.Endpoint to []provider.Record.
 //
-// - TXT ownership records: keep type TXT, strip surrounding quotes on targets.
-// - CNAME/ALIAS: ensure targets end with a trailing dot (FQDN) for SakuraCloud.
-// - TTL: use endpoint.RecordTTL if given (>0), otherwise fall back to 3600.
-// - Name: convert to relative record name by trimming the zone suffix when present.
-// - ALIAS: detected via providerSpecific "alias=true" on a CNAME endpoint.
+//   - TXT ownership records (named per reg): keep type TXT, strip surrounding quotes on targets.
+//   - CNAME/ALIAS: ensure targets end with a trailing dot (FQDN) for SakuraCloud.
+//   - AAAA: rewrite IPv6 targets to their canonical (RFC 5952) form.
+//   - MX: parse "<preference> <exchange>", validate the preference range and
+//     ensure the exchange host ends with a trailing dot.
+//   - SRV: parse "<priority> <weight> <port> <target>", validate each number
+//     and ensure the target host ends with a trailing dot.
+//   - CAA: parse `<flags> <tag> "<value>"`, allowing only the issue, issuewild
+//     and iodef tags, and re-quote the value.
+//   - TTL: use endpoint.RecordTTL if given (>0), otherwise fall back to 3600.
+//   - Name: convert to the relative record name of zone via provider.RelativeName,
+//     so the apex becomes "@" and "*.<zone>" becomes "*".
+//   - ALIAS: detected via providerSpecific "alias=true" on a CNAME endpoint.
 //
-func convertEndpoints(endpoints []*endpoint.Endpoint, zoneSuffix, txtPrefix string) []provider.Record {
+// Targets that cannot be parsed for their record type are left out and
+// reported together in a *provider.ValidationError.
+func convertEndpoints(ctx context.Context, endpoints []*endpoint.Endpoint, zone string, reg *registry.Registry) (_ []provider.Record, err error) {
+	_, span := tracer.Start(ctx, "convertEndpoints", trace.WithAttributes(
+		tracing.ZoneAttr(zone),
+		attribute.Int("endpoints", len(endpoints)),
+	))
+	defer func() {
+		tracing.RecordError(span, err)
+		span.End()
+	}()
+
 	var records []provider.Record
+	var problems []provider.Problem
 	for _, e := range endpoints {
 		if e == nil {
 			continue
 		}
 
 		var recType string
-		if e.RecordType == "TXT" && strings.HasPrefix(e.DNSName, txtPrefix) {
+		if e.RecordType == "TXT" && reg.IsRegistryName(e.DNSName) {
 			// Always treat registry entries as TXT
 			recType = "TXT"
 		} else {
 			// Otherwise, honor provided type and alias flag
 			recType = e.RecordType
-			if recType == "CNAME" {
-				for _, ps := range e.ProviderSpecific {
-					if ps.Name == "alias" && ps.Value == "true" {
-						recType = "ALIAS"
-						break
-					}
-				}
+			if recType == "CNAME" && isAlias(e) {
+				recType = "ALIAS"
 			}
 		}
 
-		// Convert to relative name with safe zone trimming
-		name := safeTrimZoneSuffix(e.DNSName, zoneSuffix)
+		name := provider.RelativeName(e.DNSName, zone)
+		// Problems name the endpoint the way provider.Validate does
+		fqdn := provider.FQDN(name, zone)
 
 		// Normalize targets per record type
 		targets := make([]string, 0, len(e.Targets))
@@ -99,9 +110,39 @@ func convertEndpoints(endpoints []*endpoint.Endpoint, zoneSuffix, txtPrefix stri
 				if !strings.HasSuffix(t, ".") {
 					t += "."
 				}
+			case "AAAA":
+				// Canonical IPv6 form so deletions match what SakuraCloud returns
+				if addr, err := netip.ParseAddr(t); err == nil && addr.Is6() {
+					t = addr.String()
+				}
+			case "MX":
+				mx, err := provider.ParseMX(t)
+				if err != nil {
+					problems = append(problems, provider.Problem{DNSName: fqdn, RecordType: recType, Target: t, Reason: err.Error()})
+					continue
+				}
+				t = mx.String()
+			case "SRV":
+				srv, err := provider.ParseSRV(t)
+				if err != nil {
+					problems = append(problems, provider.Problem{DNSName: fqdn, RecordType: recType, Target: t, Reason: err.Error()})
+					continue
+				}
+				t = srv.String()
+			case "CAA":
+				caa, err := provider.ParseCAA(t)
+				if err != nil {
+					problems = append(problems, provider.Problem{DNSName: fqdn, RecordType: recType, Target: t, Reason: err.Error()})
+					continue
+				}
+				t = caa.String()
 			}
 			targets = append(targets, t)
 		}
+		if len(targets) == 0 && len(e.Targets) > 0 {
+			// Every target was reported above
+			continue
+		}
 
 		ttl := 3600
 		if e.RecordTTL > 0 {
@@ -115,7 +156,10 @@ func convertEndpoints(endpoints []*endpoint.Endpoint, zoneSuffix, txtPrefix stri
 			TTL:     ttl,
 		})
 	}
-	return records
+	if len(problems) > 0 {
+		return records, &provider.ValidationError{Zone: zone, Problems: problems}
+	}
+	return records, nil
 }
 
 // ApplyHandler handles POST /records calls.
@@ -124,61 +168,172 @@ func convertEndpoints(endpoints []*endpoint.Endpoint, zoneSuffix, txtPrefix stri
 // ensures proper trailing dots for CNAME/ALIAS,
 // and respects the "alias=true" providerSpecific flag.
 //
+// Every endpoint is routed to the zone with the longest matching suffix and
+// each zone receives its own ApplyChanges call. A CNAME at a zone apex is
+// turned into an ALIAS or refused with 400 Bad Request, depending on
+// zones.AliasApexCNAME.
+//
+// Targets that cannot be parsed, refused apex CNAMEs and records failing
+// provider.Validate are collected for every zone, and the changes are
+// then checked against the current records of every zone with CheckChanges,
+// all before any zone is written. Problems are returned together as a JSON
+// list with 400 Bad Request.
+//
+// A change to a protected record is answered with 403 Forbidden before any
+// zone is read, and an update refused by the deletion limits of a zone with
+// 422 Unprocessable Entity before any zone is written.
+//
+// When reg enforces ownership, creates, deletes and updates of names whose
+// registry TXT record names another owner are refused with 409 Conflict and
+// nothing is applied.
+//
 // Additionally, this handler supports ExternalDNS "updateOld/updateNew" by
 // projecting them to delete+create operations to keep the provider side simple.
-func ApplyHandler(client Provider) http.HandlerFunc {
+func ApplyHandler(zones *Zones, reg *registry.Registry) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[ApplyHandler] %s %s", r.Method, r.URL.Path)
+		ctx, span := tracer.Start(r.Context(), "ApplyHandler")
+		defer span.End()
+		logger := logging.FromContext(ctx)
 
 		if ct := r.Header.Get("Content-Type"); ct != "application/external.dns.webhook+json;version=1" {
-			log.Printf("[ApplyHandler] invalid Content-Type: %s", ct)
+			logger.Warn("invalid content type", "content_type", ct)
 			http.Error(w, "invalid content type", http.StatusUnsupportedMediaType)
 			return
 		}
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Printf("[ApplyHandler] error reading body: %v", err)
+			logger.Warn("failed to read request body", logging.KeyError, err)
 			http.Error(w, "failed to read request body", http.StatusBadRequest)
 			return
 		}
-		log.Printf("[ApplyHandler] raw request body: %s", string(body))
+		logger.Debug("request payload", "body", string(body))
 
 		var req ChangeRequest
 		if err := json.Unmarshal(body, &req); err != nil {
-			log.Printf("[ApplyHandler] error decoding payload: %v", err)
+			logger.Warn("failed to decode payload", logging.KeyError, err)
 			http.Error(w, "failed to decode request payload", http.StatusBadRequest)
 			return
 		}
 
-		// Prepare suffix for trimming zone from DNS names
-		zoneSuffix := "." + client.GetZoneName()
-		// TXT registry prefix
-		txtPrefix := "_external-dns."
-
-		toCreate := convertEndpoints(req.Create, zoneSuffix, txtPrefix)
-		toDelete := convertEndpoints(req.Delete, zoneSuffix, txtPrefix)
+		creates := zones.splitByZone(ctx, req.Create)
+		deletes := zones.splitByZone(ctx, req.Delete)
+		updateOlds := zones.splitByZone(ctx, req.UpdateOld)
+		updateNews := zones.splitByZone(ctx, req.UpdateNew)
 
-		// Convert updates into delete+create to surface them to the provider
-		updateOld := convertEndpoints(req.UpdateOld, zoneSuffix, txtPrefix)
-		updateNew := convertEndpoints(req.UpdateNew, zoneSuffix, txtPrefix)
-		if len(updateOld) > 0 || len(updateNew) > 0 {
-			toDelete = append(toDelete, updateOld...)
-			toCreate = append(toCreate, updateNew...)
+		// Convert and check the changes of every zone before touching any of them
+		type zoneChange struct {
+			toCreate, toDelete []provider.Record
+		}
+		changes := make(map[string]zoneChange, len(zones.Names()))
+		var problems []provider.Problem
+		var protectErr error
+		for _, zone := range zones.Names() {
+			// Convert updates into delete+create to surface them to the provider
+			toCreateEps, err := zones.apexCNAMEs(ctx, zone, append(creates[zone], updateNews[zone]...))
+			problems = append(problems, endpointProblems(err)...)
+			toDeleteEps, err := zones.apexCNAMEs(ctx, zone, append(deletes[zone], updateOlds[zone]...))
+			problems = append(problems, endpointProblems(err)...)
+			toCreate, err := convertEndpoints(ctx, toCreateEps, zone, reg)
+			problems = append(problems, endpointProblems(err)...)
+			toDelete, err := convertEndpoints(ctx, toDeleteEps, zone, reg)
+			problems = append(problems, endpointProblems(err)...)
+			changes[zone] = zoneChange{toCreate: toCreate, toDelete: toDelete}
+			problems = append(problems, provider.Validate(zone, toCreate, toDelete)...)
+			if err := zones.Provider(zone).CheckProtected(toCreate, toDelete); err != nil && protectErr == nil {
+				protectErr = err
+			}
+		}
+		if len(problems) > 0 {
+			writeProblems(w, logger, problems)
+			return
+		}
+		if protectErr != nil {
+			logger.Warn("refusing change to protected record", logging.KeyError, protectErr)
+			writeApplyError(w, logger, protectErr)
+			return
 		}
 
-		log.Printf("[ApplyHandler] create count: %d, delete count: %d (updateOld=%d, updateNew=%d)",
-			len(toCreate), len(toDelete), len(req.UpdateOld), len(req.UpdateNew))
+		// Creates, deletes and both sides of updates must belong to this owner
+		var conflicts []registry.Conflict
+		for _, zone := range zones.Names() {
+			var modified []*endpoint.Endpoint
+			for _, eps := range [][]*endpoint.Endpoint{creates[zone], deletes[zone], updateOlds[zone], updateNews[zone]} {
+				modified = append(modified, eps...)
+			}
+			if !reg.Enforced() || len(modified) == 0 {
+				continue
+			}
+			owners, err := zoneOwners(ctx, zones.Provider(zone), zone, reg)
+			if err != nil {
+				logger.Error("failed to read registry owners", logging.KeyZone, zone, logging.KeyError, err)
+				tracing.RecordError(span, err)
+				http.Error(w, "failed to read TXT registry", http.StatusInternalServerError)
+				return
+			}
+			conflicts = append(conflicts, reg.Check(modified, owners)...)
+		}
+		if len(conflicts) > 0 {
+			writeConflicts(w, logger, conflicts)
+			return
+		}
 
-		if err := client.ApplyChanges(r.Context(), toCreate, toDelete); err != nil {
-			log.Printf("[ApplyHandler] error applying changes: %v", err)
-			http.Error(w, "failed to apply DNS changes", http.StatusInternalServerError)
+		// Check the changes against the current records of every zone, so a
+		// batch invalid in one zone leaves the others untouched
+		for _, zone := range zones.Names() {
+			toCreate, toDelete := changes[zone].toCreate, changes[zone].toDelete
+			if err := zones.Provider(zone).CheckChanges(ctx, toCreate, toDelete); err != nil {
+				var invalid *provider.ValidationError
+				if errors.As(err, &invalid) {
+					problems = append(problems, invalid.Problems...)
+					continue
+				}
+				logger.Error("failed to check changes", logging.KeyZone, zone, logging.KeyError, err)
+				tracing.RecordError(span, err)
+				writeApplyError(w, logger, err)
+				return
+			}
+		}
+		if len(problems) > 0 {
+			writeProblems(w, logger, problems)
 			return
 		}
 
+		for _, zone := range zones.Names() {
+			toCreate, toDelete := changes[zone].toCreate, changes[zone].toDelete
+			logger.Info("applying changes", logging.KeyZone, zone,
+				"create", len(toCreate), "delete", len(toDelete),
+				"update_old", len(updateOlds[zone]), "update_new", len(updateNews[zone]))
+
+			if err := zones.Provider(zone).ApplyChanges(ctx, toCreate, toDelete); err != nil {
+				logger.Error("failed to apply changes", logging.KeyZone, zone, logging.KeyError, err)
+				tracing.RecordError(span, err)
+				writeApplyError(w, logger, err)
+				return
+			}
+		}
+
 		// On success, return 204 No Content
 		w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
 		w.WriteHeader(http.StatusNoContent)
-		log.Printf("[ApplyHandler] successfully applied DNS changes")
+		logger.Info("applied DNS changes")
+	}
+}
+
+// writeApplyError answers a failed zone check or update with the status
+// matching err.
+func writeApplyError(w http.ResponseWriter, logger *slog.Logger, err error) {
+	var invalid *provider.ValidationError
+	switch {
+	case errors.As(err, &invalid):
+		writeProblems(w, logger, invalid.Problems)
+	case errors.Is(err, provider.ErrIntentConflict):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, provider.ErrProtectedRecord):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, provider.ErrDeletionLimit):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, "failed to apply DNS changes", http.StatusInternalServerError)
 	}
 }
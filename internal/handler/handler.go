@@ -17,12 +17,19 @@ package handler
 import (
 	"context"
 
+	"go.opentelemetry.io/otel"
+
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
 )
 
+// tracer creates the spans of the webhook handlers.
+var tracer = otel.Tracer("github.com/sacloud/external-dns-sacloud-webhook/internal/handler")
+
 // To enable dependency injection, handlers use interface-based programming instead of concrete types.
 type Provider interface {
 	ListRecords(ctx context.Context) ([]provider.Record, error)
 	ApplyChanges(ctx context.Context, create, delete []provider.Record) error
+	CheckChanges(ctx context.Context, create, delete []provider.Record) error
+	CheckProtected(create, delete []provider.Record) error
 	GetZoneName() string
 }
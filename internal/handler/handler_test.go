@@ -19,24 +19,37 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/registry"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
 type fakeProvider struct {
+	// Zone served by this fake; defaults to "example.com"
+	zone string
+
 	// For RecordsHandler tests
 	records []provider.Record
 	listErr error
 
 	// For ApplyHandler tests
-	createIn []provider.Record
-	deleteIn []provider.Record
-	applyErr error
+	createIn   []provider.Record
+	deleteIn   []provider.Record
+	applyErr   error
+	checkErr   error
+	protectErr error
 }
 
 func (f *fakeProvider) ListRecords(ctx context.Context) ([]provider.Record, error) {
@@ -49,7 +62,18 @@ func (f *fakeProvider) ApplyChanges(ctx context.Context, create, del []provider.
 	return f.applyErr
 }
 
+func (f *fakeProvider) CheckChanges(ctx context.Context, create, del []provider.Record) error {
+	return f.checkErr
+}
+
+func (f *fakeProvider) CheckProtected(create, del []provider.Record) error {
+	return f.protectErr
+}
+
 func (f *fakeProvider) GetZoneName() string {
+	if f.zone != "" {
+		return f.zone
+	}
 	return "example.com"
 }
 
@@ -60,7 +84,7 @@ func TestRecordsHandler_Success(t *testing.T) {
 			{Type: "CNAME", Name: "www", Targets: []string{"example.com."}},
 		},
 	}
-	handler := RecordsHandler(fake)
+	handler := RecordsHandler(NewZones(fake))
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/records", nil)
@@ -84,7 +108,7 @@ func TestRecordsHandler_Success(t *testing.T) {
 
 func TestRecordsHandler_Error(t *testing.T) {
 	fake := &fakeProvider{listErr: errors.New("fail")}
-	handler := RecordsHandler(fake)
+	handler := RecordsHandler(NewZones(fake))
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/records", nil)
@@ -97,7 +121,7 @@ func TestRecordsHandler_Error(t *testing.T) {
 
 func TestAdjustHandler_PassThrough(t *testing.T) {
 	fake := &fakeProvider{}
-	handler := AdjustHandler(fake)
+	handler := AdjustHandler(NewZones(fake), nil)
 
 	input := []endpoint.Endpoint{
 		{DNSName: "a.example.com", Targets: []string{"1.1.1.1"}, RecordType: "A"},
@@ -124,7 +148,7 @@ func TestAdjustHandler_PassThrough(t *testing.T) {
 
 func TestAdjustHandler_BadContentType(t *testing.T) {
 	fake := &fakeProvider{}
-	handler := AdjustHandler(fake)
+	handler := AdjustHandler(NewZones(fake), nil)
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodPost, "/adjustendpoints", nil)
@@ -138,7 +162,7 @@ func TestAdjustHandler_BadContentType(t *testing.T) {
 
 func TestApplyHandler_Success_CreateDeleteOnly(t *testing.T) {
 	fake := &fakeProvider{}
-	handler := ApplyHandler(fake)
+	handler := ApplyHandler(NewZones(fake), nil)
 
 	cr := ChangeRequest{
 		Create: []*endpoint.Endpoint{
@@ -175,7 +199,7 @@ func TestApplyHandler_Success_CreateDeleteOnly(t *testing.T) {
 
 func TestApplyHandler_Success_WithUpdates_MappedToDeleteCreate(t *testing.T) {
 	fake := &fakeProvider{}
-	handler := ApplyHandler(fake)
+	handler := ApplyHandler(NewZones(fake), nil)
 
 	cr := ChangeRequest{
 		// No direct create/delete
@@ -184,10 +208,10 @@ func TestApplyHandler_Success_WithUpdates_MappedToDeleteCreate(t *testing.T) {
 		// Simulate TTL update for the same CNAME with alias=true
 		UpdateOld: []*endpoint.Endpoint{
 			{
-				DNSName:      "cname.example.com",
-				RecordType:   "CNAME",
-				RecordTTL:    120,
-				Targets:      endpoint.Targets{"target.example.com."},
+				DNSName:    "cname.example.com",
+				RecordType: "CNAME",
+				RecordTTL:  120,
+				Targets:    endpoint.Targets{"target.example.com."},
 				ProviderSpecific: endpoint.ProviderSpecific{
 					{Name: "alias", Value: "true"},
 				},
@@ -195,10 +219,10 @@ func TestApplyHandler_Success_WithUpdates_MappedToDeleteCreate(t *testing.T) {
 		},
 		UpdateNew: []*endpoint.Endpoint{
 			{
-				DNSName:      "cname.example.com",
-				RecordType:   "CNAME",
-				RecordTTL:    3600,
-				Targets:      endpoint.Targets{"target.example.com"}, // no trailing dot -> should be normalized to end with dot
+				DNSName:    "cname.example.com",
+				RecordType: "CNAME",
+				RecordTTL:  3600,
+				Targets:    endpoint.Targets{"target.example.com"}, // no trailing dot -> should be normalized to end with dot
 				ProviderSpecific: endpoint.ProviderSpecific{
 					{Name: "alias", Value: "true"},
 				},
@@ -247,7 +271,7 @@ func TestApplyHandler_Success_WithUpdates_MappedToDeleteCreate(t *testing.T) {
 
 func TestApplyHandler_BadContentType(t *testing.T) {
 	fake := &fakeProvider{}
-	handler := ApplyHandler(fake)
+	handler := ApplyHandler(NewZones(fake), nil)
 
 	body, _ := json.Marshal(ChangeRequest{})
 	rr := httptest.NewRecorder()
@@ -262,7 +286,7 @@ func TestApplyHandler_BadContentType(t *testing.T) {
 
 func TestApplyHandler_BadJSON(t *testing.T) {
 	fake := &fakeProvider{}
-	handler := ApplyHandler(fake)
+	handler := ApplyHandler(NewZones(fake), nil)
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader([]byte(`{bad`)))
@@ -276,7 +300,7 @@ func TestApplyHandler_BadJSON(t *testing.T) {
 
 func TestApplyHandler_ProviderError(t *testing.T) {
 	fake := &fakeProvider{applyErr: errors.New("oops")}
-	handler := ApplyHandler(fake)
+	handler := ApplyHandler(NewZones(fake), nil)
 
 	cr := ChangeRequest{Create: nil, Delete: nil}
 	body, _ := json.Marshal(cr)
@@ -295,7 +319,7 @@ func TestRecordsHandler_ContextTimeout(t *testing.T) {
 	fake := &fakeProvider{
 		listErr: context.Canceled,
 	}
-	handler := RecordsHandler(fake)
+	handler := RecordsHandler(NewZones(fake))
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/records", nil)
@@ -310,7 +334,7 @@ func TestApplyHandler_ContextTimeout(t *testing.T) {
 	fake := &fakeProvider{
 		applyErr: context.Canceled,
 	}
-	handler := ApplyHandler(fake)
+	handler := ApplyHandler(NewZones(fake), nil)
 
 	cr := ChangeRequest{Create: nil, Delete: nil}
 	body, _ := json.Marshal(cr)
@@ -328,8 +352,8 @@ func TestApplyHandler_ContextTimeout(t *testing.T) {
 // Optional sanity test: ensure convertEndpoints keeps TXT ownership formatting.
 // (This is a white-box-ish test; if you prefer black-box, you can rely on the ALIAS update test above.)
 func Test_convertEndpoints_TXT_and_AliasNormalization(t *testing.T) {
-	zoneSuffix := ".example.com"
-	txtPrefix := "_external-dns."
+	zone := "example.com"
+	reg := &registry.Registry{Prefix: "_external-dns."}
 
 	in := []*endpoint.Endpoint{
 		{
@@ -347,7 +371,10 @@ func Test_convertEndpoints_TXT_and_AliasNormalization(t *testing.T) {
 		},
 	}
 
-	got := convertEndpoints(in, zoneSuffix, txtPrefix)
+	got, err := convertEndpoints(context.Background(), in, zone, reg)
+	if err != nil {
+		t.Fatalf("convertEndpoints() unexpected error: %v", err)
+	}
 
 	want := []provider.Record{
 		{Type: "TXT", Name: "_external-dns.cname-foo", Targets: []string{"heritage=external-dns,owner=default"}, TTL: 3600},
@@ -358,3 +385,732 @@ func Test_convertEndpoints_TXT_and_AliasNormalization(t *testing.T) {
 		t.Fatalf("convertEndpoints mismatch:\n got = %#v\nwant = %#v", got, want)
 	}
 }
+
+func TestZones_MatchLongestSuffix(t *testing.T) {
+	zones := NewZones(
+		&fakeProvider{zone: "example.com"},
+		&fakeProvider{zone: "prod.example.com"},
+		&fakeProvider{zone: "example.jp"},
+	)
+
+	cases := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{"www.example.com", "example.com", true},
+		{"api.prod.example.com", "prod.example.com", true},
+		{"prod.example.com.", "prod.example.com", true},
+		{"WWW.Example.JP", "example.jp", true},
+		{"badexample.com", "", false},
+		{"example.org", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := zones.Match(tc.name)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("Match(%q) = (%q, %v); want (%q, %v)", tc.name, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestApplyHandler_RoutesByZone(t *testing.T) {
+	parent := &fakeProvider{zone: "example.com"}
+	child := &fakeProvider{zone: "prod.example.com"}
+	other := &fakeProvider{zone: "example.jp"}
+	handler := ApplyHandler(NewZones(parent, child, other), nil)
+
+	cr := ChangeRequest{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "www.example.com", Targets: []string{"1.1.1.1"}, RecordType: "A"},
+			{DNSName: "api.prod.example.com", Targets: []string{"2.2.2.2"}, RecordType: "A"},
+			{DNSName: "unmanaged.example.org", Targets: []string{"4.4.4.4"}, RecordType: "A"},
+		},
+		Delete: []*endpoint.Endpoint{
+			{DNSName: "mail.example.jp", Targets: []string{"3.3.3.3"}, RecordType: "A"},
+		},
+	}
+	body, _ := json.Marshal(cr)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 No Content, got %d", rr.Code)
+	}
+	if len(parent.createIn) != 1 || parent.createIn[0].Name != "www" {
+		t.Errorf("unexpected creates for example.com: %+v", parent.createIn)
+	}
+	if len(child.createIn) != 1 || child.createIn[0].Name != "api" {
+		t.Errorf("unexpected creates for prod.example.com: %+v", child.createIn)
+	}
+	if len(other.createIn) != 0 || len(other.deleteIn) != 1 || other.deleteIn[0].Name != "mail" {
+		t.Errorf("unexpected changes for example.jp: create=%+v delete=%+v", other.createIn, other.deleteIn)
+	}
+}
+
+func TestRecordsHandler_MultipleZones(t *testing.T) {
+	zones := NewZones(
+		&fakeProvider{zone: "example.com", records: []provider.Record{
+			{Type: "A", Name: "www", Targets: []string{"1.1.1.1"}},
+		}},
+		&fakeProvider{zone: "example.jp", records: []provider.Record{
+			{Type: "A", Name: "www", Targets: []string{"2.2.2.2"}},
+		}},
+	)
+	handler := RecordsHandler(zones)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/records", nil)
+	handler(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", rr.Code)
+	}
+	var eps []endpoint.Endpoint
+	if err := json.Unmarshal(rr.Body.Bytes(), &eps); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	var names []string
+	for _, ep := range eps {
+		names = append(names, ep.DNSName)
+	}
+	want := []string{"www.example.com", "www.example.jp"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("unexpected endpoint names: got %v, want %v", names, want)
+	}
+}
+
+func Test_convertEndpoints_AAAACanonicalForm(t *testing.T) {
+	in := []*endpoint.Endpoint{
+		{
+			DNSName:    "v6.example.com",
+			RecordType: "AAAA",
+			Targets:    endpoint.Targets{"2001:0DB8:0000:0000:0000:0000:0000:0001", "2001:db8::2"},
+		},
+	}
+
+	got, err := convertEndpoints(context.Background(), in, "example.com", nil)
+	if err != nil {
+		t.Fatalf("convertEndpoints() unexpected error: %v", err)
+	}
+
+	want := []provider.Record{
+		{Type: "AAAA", Name: "v6", Targets: []string{"2001:db8::1", "2001:db8::2"}, TTL: 3600},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("convertEndpoints mismatch:\n got = %#v\nwant = %#v", got, want)
+	}
+}
+
+func Test_convertEndpoints_MX(t *testing.T) {
+	in := []*endpoint.Endpoint{
+		{
+			DNSName:    "example.com",
+			RecordType: "MX",
+			Targets:    endpoint.Targets{"10 mail.example.com", "20  Backup.Example.com."},
+		},
+	}
+
+	got, err := convertEndpoints(context.Background(), in, "example.com", nil)
+	if err != nil {
+		t.Fatalf("convertEndpoints() unexpected error: %v", err)
+	}
+	want := []string{"10 mail.example.com.", "20 Backup.Example.com."}
+	if !reflect.DeepEqual(got[0].Targets, want) {
+		t.Errorf("MX targets = %#v; want %#v", got[0].Targets, want)
+	}
+}
+
+func TestApplyHandler_InvalidMXPriority(t *testing.T) {
+	fake := &fakeProvider{}
+	handler := ApplyHandler(NewZones(fake), nil)
+
+	targets := []string{"70000 mail.example.com", "-1 mail.example.com", "mail.example.com"}
+	cr := ChangeRequest{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "Example.com.", Targets: targets, RecordType: "MX"},
+			{DNSName: "EXAMPLE.com", Targets: []string{"lb.example.net"}, RecordType: "CNAME"},
+		},
+	}
+	body, _ := json.Marshal(cr)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 Bad Request, got %d", rr.Code)
+	}
+	if fake.createIn != nil {
+		t.Errorf("ApplyChanges should not be called on invalid MX, got %+v", fake.createIn)
+	}
+	var resp validationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rr.Body.String(), err)
+	}
+	// Every bad target and the refused apex CNAME are reported at once
+	var got []string
+	for _, p := range resp.Problems {
+		got = append(got, p.RecordType+" "+p.Target)
+	}
+	want := []string{"CNAME ", "MX 70000 mail.example.com", "MX -1 mail.example.com", "MX mail.example.com"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("problems = %q; want %q", got, want)
+	}
+	// Names are reported in the normalized form provider.Validate uses
+	for _, p := range resp.Problems {
+		if p.DNSName != "example.com" {
+			t.Errorf("problem name = %q; want example.com", p.DNSName)
+		}
+	}
+}
+
+func Test_convertEndpoints_SRV(t *testing.T) {
+	in := []*endpoint.Endpoint{
+		{
+			DNSName:    "_sip._tcp.example.com",
+			RecordType: "SRV",
+			Targets:    endpoint.Targets{"10 5 5060 sip.example.com"},
+		},
+	}
+
+	got, err := convertEndpoints(context.Background(), in, "example.com", nil)
+	if err != nil {
+		t.Fatalf("convertEndpoints() unexpected error: %v", err)
+	}
+	want := []provider.Record{
+		{Type: "SRV", Name: "_sip._tcp", Targets: []string{"10 5 5060 sip.example.com."}, TTL: 3600},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("convertEndpoints mismatch:\n got = %#v\nwant = %#v", got, want)
+	}
+
+	in[0].Targets = endpoint.Targets{"10 5 99999 sip.example.com"}
+	if _, err := convertEndpoints(context.Background(), in, "example.com", nil); err == nil {
+		t.Error("convertEndpoints() expected error for out-of-range SRV port")
+	}
+}
+
+func TestApplyHandler_CAA(t *testing.T) {
+	fake := &fakeProvider{}
+	handler := ApplyHandler(NewZones(fake), nil)
+
+	cr := ChangeRequest{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "example.com", Targets: []string{`0 issue "letsencrypt.org"`}, RecordType: "CAA"},
+		},
+	}
+	body, _ := json.Marshal(cr)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 No Content, got %d", rr.Code)
+	}
+	if got := fake.createIn[0].Targets; !reflect.DeepEqual(got, []string{`0 issue "letsencrypt.org"`}) {
+		t.Errorf("unexpected CAA targets: %#v", got)
+	}
+
+	cr.Create[0].Targets = endpoint.Targets{`0 tbs "letsencrypt.org"`}
+	body, _ = json.Marshal(cr)
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 Bad Request for unknown CAA tag, got %d", rr.Code)
+	}
+}
+
+func TestRecordsHandler_GroupsTargetsByNameAndType(t *testing.T) {
+	fake := &fakeProvider{
+		records: []provider.Record{
+			{Type: "A", Name: "lb", Targets: []string{"1.1.1.1"}, TTL: 300},
+			{Type: "TXT", Name: "lb", Targets: []string{"v=spf1 -all"}, TTL: 300},
+			{Type: "A", Name: "lb", Targets: []string{"2.2.2.2"}, TTL: 300},
+		},
+	}
+	handler := RecordsHandler(NewZones(fake))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/records", nil)
+	handler(rr, req)
+
+	var eps []endpoint.Endpoint
+	if err := json.Unmarshal(rr.Body.Bytes(), &eps); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if len(eps) != 2 {
+		t.Fatalf("expected 2 endpoints, got %d: %+v", len(eps), eps)
+	}
+	if eps[0].RecordType != "A" || !reflect.DeepEqual([]string(eps[0].Targets), []string{"1.1.1.1", "2.2.2.2"}) {
+		t.Errorf("unexpected grouped A endpoint: %+v", eps[0])
+	}
+}
+
+func TestApplyHandler_OwnershipConflict(t *testing.T) {
+	fake := &fakeProvider{
+		records: []provider.Record{
+			{Type: "TXT", Name: "_external-dns.a-theirs", Targets: []string{"heritage=external-dns,external-dns/owner=cluster-b"}},
+			{Type: "A", Name: "theirs", Targets: []string{"1.1.1.1"}},
+			{Type: "TXT", Name: "_external-dns.a-mine", Targets: []string{"heritage=external-dns,external-dns/owner=cluster-a"}},
+			{Type: "A", Name: "mine", Targets: []string{"2.2.2.2"}},
+		},
+	}
+	handler := ApplyHandler(NewZones(fake), &registry.Registry{OwnerID: "cluster-a", Prefix: "_external-dns."})
+
+	post := func(cr ChangeRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(cr)
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		handler(rr, req)
+		return rr
+	}
+
+	rr := post(ChangeRequest{
+		Delete: []*endpoint.Endpoint{
+			{DNSName: "mine.example.com", Targets: []string{"2.2.2.2"}, RecordType: "A"},
+			{DNSName: "theirs.example.com", Targets: []string{"1.1.1.1"}, RecordType: "A"},
+		},
+	})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 Conflict, got %d", rr.Code)
+	}
+	var resp conflictResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if len(resp.Conflicts) != 1 || resp.Conflicts[0].DNSName != "theirs.example.com" || resp.Conflicts[0].Owner != "cluster-b" {
+		t.Errorf("unexpected conflicts: %+v", resp.Conflicts)
+	}
+	if fake.deleteIn != nil {
+		t.Errorf("ApplyChanges should not be called on conflict, got delete=%+v", fake.deleteIn)
+	}
+
+	rr = post(ChangeRequest{
+		UpdateOld: []*endpoint.Endpoint{{DNSName: "mine.example.com", Targets: []string{"2.2.2.2"}, RecordType: "A"}},
+		UpdateNew: []*endpoint.Endpoint{{DNSName: "mine.example.com", Targets: []string{"3.3.3.3"}, RecordType: "A"}},
+	})
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 No Content for own records, got %d", rr.Code)
+	}
+
+	// Creates may not add targets or registry records to another owner's names
+	fake.createIn = nil
+	rr = post(ChangeRequest{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "theirs.example.com", Targets: []string{"6.6.6.6"}, RecordType: "A"},
+			{DNSName: "_external-dns.a-theirs.example.com", Targets: []string{"heritage=external-dns,external-dns/owner=cluster-a"}, RecordType: "TXT"},
+			{DNSName: "new.example.com", Targets: []string{"7.7.7.7"}, RecordType: "A"},
+		},
+	})
+	if rr.Code != http.StatusConflict {
+		t.Fatalf("expected 409 Conflict for creates on another owner's names, got %d", rr.Code)
+	}
+	resp = conflictResponse{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp.Conflicts) != 2 {
+		t.Errorf("response = %s; want two conflicts", rr.Body.String())
+	}
+	if fake.createIn != nil {
+		t.Errorf("ApplyChanges should not be called on conflict, got create=%+v", fake.createIn)
+	}
+}
+
+func TestAdjustHandler_DropsEndpointsOwnedByOthers(t *testing.T) {
+	fake := &fakeProvider{
+		records: []provider.Record{
+			{Type: "TXT", Name: "_external-dns.a-theirs", Targets: []string{"heritage=external-dns,external-dns/owner=cluster-b"}},
+		},
+	}
+	handler := AdjustHandler(NewZones(fake), &registry.Registry{OwnerID: "cluster-a", Prefix: "_external-dns."})
+
+	input := []endpoint.Endpoint{
+		{DNSName: "theirs.example.com", Targets: []string{"1.1.1.1"}, RecordType: "A"},
+		{DNSName: "mine.example.com", Targets: []string{"2.2.2.2"}, RecordType: "A"},
+	}
+	body, _ := json.Marshal(input)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/adjustendpoints", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	var out []endpoint.Endpoint
+	if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if len(out) != 1 || out[0].DNSName != "mine.example.com" {
+		t.Errorf("unexpected adjusted endpoints: %+v", out)
+	}
+}
+
+func TestApplyHandler_IntentConflict(t *testing.T) {
+	fake := &fakeProvider{applyErr: fmt.Errorf("%w: www CNAME already points to c.example.net.", provider.ErrIntentConflict)}
+	handler := ApplyHandler(NewZones(fake), nil)
+
+	body, _ := json.Marshal(ChangeRequest{})
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected 409 Conflict on intent conflict, got %d", rr.Code)
+	}
+}
+
+func TestApplyHandler_PayloadLoggedOnlyAtDebug(t *testing.T) {
+	body := `{"create":[{"dnsName":"a.example.com","recordType":"TXT","targets":["\"heritage=external-dns,external-dns/owner=secret-owner\""]}]}`
+
+	for _, level := range []string{"info", "debug"} {
+		var buf bytes.Buffer
+		logger, err := logging.New(&buf, level, "text")
+		if err != nil {
+			t.Fatalf("logging.New() unexpected error: %v", err)
+		}
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+		req = req.WithContext(logging.WithLogger(req.Context(), logger))
+		req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		ApplyHandler(NewZones(&fakeProvider{}), nil)(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("level=%s: expected 204, got %d", level, rr.Code)
+		}
+		out := buf.String()
+		if strings.Contains(out, "secret-owner") {
+			t.Errorf("level=%s: TXT registry contents leaked into logs: %s", level, out)
+		}
+		if got := strings.Contains(out, "request payload"); got != (level == "debug") {
+			t.Errorf("level=%s: payload logged = %v", level, got)
+		}
+	}
+}
+
+func TestApplyHandler_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	body := `{"create":[{"dnsName":"a.example.com","recordType":"A","targets":["1.2.3.4"]}]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	ApplyHandler(NewZones(&fakeProvider{}), nil)(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", rr.Code)
+	}
+	parents := map[string]string{}
+	ids := map[string]string{}
+	for _, s := range recorder.Ended() {
+		ids[s.SpanContext().SpanID().String()] = s.Name()
+		parents[s.Name()] = s.Parent().SpanID().String()
+	}
+	if _, ok := parents["ApplyHandler"]; !ok {
+		t.Fatalf("no ApplyHandler span recorded; got %v", parents)
+	}
+	if p, ok := parents["convertEndpoints"]; !ok || ids[p] != "ApplyHandler" {
+		t.Errorf("convertEndpoints span parent = %q; want ApplyHandler", ids[p])
+	}
+}
+
+func TestRecordsHandler_Stale(t *testing.T) {
+	fresh := &fakeProvider{
+		zone:    "example.com",
+		records: []provider.Record{{Type: "A", Name: "www", Targets: []string{"1.1.1.1"}}},
+	}
+	stale := &fakeProvider{
+		zone:    "example.jp",
+		records: []provider.Record{{Type: "A", Name: "www", Targets: []string{"2.2.2.2"}}},
+		listErr: &provider.StaleError{Zone: "example.jp", Age: 90 * time.Second, Err: errors.New("503")},
+	}
+
+	rr := httptest.NewRecorder()
+	RecordsHandler(NewZones(fresh, stale))(rr, httptest.NewRequest(http.MethodGet, "/records", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 OK, got %d", rr.Code)
+	}
+	if got := rr.Header().Get(StaleHeader); got != "example.jp" {
+		t.Errorf("%s = %q; want example.jp", StaleHeader, got)
+	}
+	if got := rr.Header().Get("Age"); got != "90" {
+		t.Errorf("Age = %q; want 90", got)
+	}
+	var eps []endpoint.Endpoint
+	if err := json.Unmarshal(rr.Body.Bytes(), &eps); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if len(eps) != 2 {
+		t.Errorf("expected 2 endpoints, got %d", len(eps))
+	}
+}
+
+func TestApplyHandler_StaleRegistryFails(t *testing.T) {
+	fake := &fakeProvider{
+		records: []provider.Record{{Type: "A", Name: "www", Targets: []string{"1.1.1.1"}}},
+		listErr: &provider.StaleError{Zone: "example.com", Age: time.Minute, Err: errors.New("503")},
+	}
+	reg := &registry.Registry{OwnerID: "me", Prefix: registry.DefaultPrefix}
+
+	body := `{"delete":[{"dnsName":"www.example.com","recordType":"A","targets":["1.1.1.1"]}]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	ApplyHandler(NewZones(fake), reg)(rr, req)
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 with stale zone data, got %d", rr.Code)
+	}
+	if fake.deleteIn != nil {
+		t.Error("ApplyChanges was called with stale zone data")
+	}
+}
+
+func TestApexAndWildcardRoundTrip(t *testing.T) {
+	fake := &fakeProvider{
+		zone: "example.com",
+		records: []provider.Record{
+			{Type: "A", Name: "@", Targets: []string{"1.1.1.1"}, TTL: 300},
+			{Type: "A", Name: "*", Targets: []string{"2.2.2.2"}, TTL: 300},
+			{Type: "A", Name: "*.dev", Targets: []string{"3.3.3.3"}, TTL: 300},
+		},
+	}
+	zones := NewZones(fake)
+
+	rr := httptest.NewRecorder()
+	RecordsHandler(zones)(rr, httptest.NewRequest(http.MethodGet, "/records", nil))
+	var eps []*endpoint.Endpoint
+	if err := json.Unmarshal(rr.Body.Bytes(), &eps); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	var names []string
+	for _, ep := range eps {
+		names = append(names, ep.DNSName)
+	}
+	if want := []string{"example.com", "*.example.com", "*.dev.example.com"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("GET /records names = %v; want %v", names, want)
+	}
+
+	// Feeding the same endpoints back must address the same records
+	body, _ := json.Marshal(ChangeRequest{Delete: eps})
+	rr = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	ApplyHandler(zones, nil)(rr, req)
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 No Content, got %d", rr.Code)
+	}
+	var deleted []string
+	for _, rec := range fake.deleteIn {
+		deleted = append(deleted, rec.Name)
+	}
+	if want := []string{"@", "*", "*.dev"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted names = %v; want %v", deleted, want)
+	}
+}
+
+func TestApplyHandler_ApexCNAME(t *testing.T) {
+	cr := ChangeRequest{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "example.com", Targets: []string{"lb.example.net"}, RecordType: "CNAME", RecordTTL: 300},
+			{DNSName: "www.example.com", Targets: []string{"lb.example.net"}, RecordType: "CNAME", RecordTTL: 300},
+		},
+	}
+	body, _ := json.Marshal(cr)
+	post := func(zones *Zones) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		ApplyHandler(zones, nil)(rr, req)
+		return rr
+	}
+
+	// Policy off: refused before reaching SakuraCloud
+	fake := &fakeProvider{zone: "example.com"}
+	if rr := post(NewZones(fake)); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 Bad Request with the policy off, got %d", rr.Code)
+	}
+	if fake.createIn != nil {
+		t.Errorf("ApplyChanges should not be called, got %+v", fake.createIn)
+	}
+
+	// Policy on: the apex CNAME becomes an ALIAS, other CNAMEs are kept
+	fake = &fakeProvider{zone: "example.com"}
+	zones := NewZones(fake)
+	zones.AliasApexCNAME = true
+	if rr := post(zones); rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 No Content with the policy on, got %d", rr.Code)
+	}
+	want := []provider.Record{
+		{Type: "ALIAS", Name: "@", Targets: []string{"lb.example.net."}, TTL: 300},
+		{Type: "CNAME", Name: "www", Targets: []string{"lb.example.net."}, TTL: 300},
+	}
+	if !reflect.DeepEqual(fake.createIn, want) {
+		t.Errorf("created records = %+v; want %+v", fake.createIn, want)
+	}
+	if len(cr.Create[0].ProviderSpecific) != 0 {
+		t.Error("request endpoint was modified in place")
+	}
+
+	// GET /records reports the ALIAS as the CNAME+alias the plan will carry
+	fake.records = fake.createIn
+	rr := httptest.NewRecorder()
+	RecordsHandler(zones)(rr, httptest.NewRequest(http.MethodGet, "/records", nil))
+	var eps []*endpoint.Endpoint
+	if err := json.Unmarshal(rr.Body.Bytes(), &eps); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if eps[0].DNSName != "example.com" || eps[0].RecordType != "CNAME" || !isAlias(eps[0]) {
+		t.Errorf("apex endpoint = %+v; want CNAME example.com with alias=true", eps[0])
+	}
+}
+
+func TestAdjustHandler_ApexCNAME(t *testing.T) {
+	desired := []*endpoint.Endpoint{
+		{DNSName: "example.com", Targets: []string{"lb.example.net"}, RecordType: "CNAME"},
+		{DNSName: "www.example.com", Targets: []string{"1.1.1.1"}, RecordType: "A"},
+	}
+	body, _ := json.Marshal(desired)
+	adjust := func(zones *Zones) []*endpoint.Endpoint {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/adjustendpoints", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		AdjustHandler(zones, nil)(rr, req)
+		var out []*endpoint.Endpoint
+		if err := json.Unmarshal(rr.Body.Bytes(), &out); err != nil {
+			t.Fatalf("invalid JSON response: %v", err)
+		}
+		return out
+	}
+
+	zones := NewZones(&fakeProvider{zone: "example.com"})
+	if out := adjust(zones); len(out) != 1 || out[0].DNSName != "www.example.com" {
+		t.Errorf("policy off: adjusted = %+v; want only www.example.com", out)
+	}
+
+	zones.AliasApexCNAME = true
+	out := adjust(zones)
+	if len(out) != 2 || !isAlias(out[0]) || isAlias(out[1]) {
+		t.Errorf("policy on: adjusted = %+v; want the apex CNAME flagged alias=true", out)
+	}
+}
+
+func TestApplyHandler_Validation(t *testing.T) {
+	fake := &fakeProvider{}
+	handler := ApplyHandler(NewZones(fake), nil)
+
+	cr := ChangeRequest{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "a.example.com", Targets: []string{"not-an-ip"}, RecordType: "A"},
+			{DNSName: "empty.example.com", Targets: []string{}, RecordType: "A"},
+			{DNSName: "ttl.example.com", Targets: []string{"192.0.2.1"}, RecordType: "A", RecordTTL: 1},
+			{DNSName: "dup.example.com", Targets: []string{"lb.example.net"}, RecordType: "CNAME"},
+			{DNSName: "dup.example.com", Targets: []string{"v=spf1 -all"}, RecordType: "TXT"},
+		},
+		Delete:    []*endpoint.Endpoint{{DNSName: "gone.example.com", RecordType: "A"}},
+		UpdateOld: []*endpoint.Endpoint{{DNSName: "old.example.com", RecordType: "A"}},
+		UpdateNew: []*endpoint.Endpoint{{DNSName: "old.example.com", Targets: []string{"192.0.2.2"}, RecordType: "A"}},
+	}
+	body, _ := json.Marshal(cr)
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	handler(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 Bad Request, got %d", rr.Code)
+	}
+	if fake.createIn != nil {
+		t.Errorf("ApplyChanges should not be called, got %+v", fake.createIn)
+	}
+	var resp validationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	var names []string
+	for _, p := range resp.Problems {
+		names = append(names, p.DNSName)
+	}
+	want := []string{"a.example.com", "empty.example.com", "ttl.example.com", "gone.example.com", "old.example.com", "dup.example.com"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("problem names = %v; want %v", names, want)
+	}
+}
+
+func TestApplyHandler_ZoneValidationError(t *testing.T) {
+	com := &fakeProvider{zone: "example.com"}
+	jp := &fakeProvider{zone: "example.jp", checkErr: &provider.ValidationError{Zone: "example.jp", Problems: []provider.Problem{
+		{DNSName: "www.example.jp", RecordType: "CNAME", Reason: "CNAME cannot coexist with A at the same name"},
+	}}}
+
+	body := `{"create":[{"dnsName":"www.example.com","recordType":"A","targets":["1.1.1.1"]},` +
+		`{"dnsName":"www.example.jp","recordType":"CNAME","targets":["lb.example.net"]}]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	ApplyHandler(NewZones(com, jp), nil)(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 Bad Request, got %d", rr.Code)
+	}
+	var resp validationResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || len(resp.Problems) != 1 {
+		t.Errorf("response = %s; want one problem", rr.Body.String())
+	}
+	if com.createIn != nil {
+		t.Errorf("example.com was written before example.jp was checked: %+v", com.createIn)
+	}
+}
+
+func TestApplyHandler_DeletionLimit(t *testing.T) {
+	com := &fakeProvider{zone: "example.com"}
+	jp := &fakeProvider{zone: "example.jp", checkErr: fmt.Errorf("%w: update would delete 3 of 4 records", provider.ErrDeletionLimit)}
+
+	body := `{"create":[{"dnsName":"www.example.com","recordType":"A","targets":["1.1.1.1"]}],` +
+		`"delete":[{"dnsName":"www.example.jp","recordType":"A","targets":["1.1.1.1"]}]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	ApplyHandler(NewZones(com, jp), nil)(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 Unprocessable Entity, got %d", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "3 of 4 records") {
+		t.Errorf("response %q does not explain the refusal", rr.Body.String())
+	}
+	if com.createIn != nil {
+		t.Errorf("example.com was written although the batch was refused: %+v", com.createIn)
+	}
+}
+
+func TestApplyHandler_ProtectedRecord(t *testing.T) {
+	com := &fakeProvider{zone: "example.com"}
+	jp := &fakeProvider{zone: "example.jp", protectErr: fmt.Errorf("%w: example.jp MX matches rule MX:@", provider.ErrProtectedRecord)}
+
+	body := `{"create":[{"dnsName":"www.example.com","recordType":"A","targets":["1.1.1.1"]}],` +
+		`"delete":[{"dnsName":"example.jp","recordType":"MX","targets":["10 mail.example.jp"]}]}`
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/external.dns.webhook+json;version=1")
+	ApplyHandler(NewZones(com, jp), nil)(rr, req)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 Forbidden, got %d", rr.Code)
+	}
+	if com.createIn != nil || jp.deleteIn != nil {
+		t.Errorf("zones were written although the batch was refused: %+v, %+v", com.createIn, jp.deleteIn)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/registry"
+)
+
+// conflictResponse is the JSON body returned with 409 Conflict when a
+// change batch touches records owned by another external-dns instance.
+type conflictResponse struct {
+	Error     string              `json:"error"`
+	Conflicts []registry.Conflict `json:"conflicts"`
+}
+
+// zoneOwners reads the current records of zone and indexes the owners
+// recorded in its TXT registry records.
+func zoneOwners(ctx context.Context, p Provider, zone string, reg *registry.Registry) (registry.Owners, error) {
+	records, err := p.ListRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return reg.Owners(recordsToEndpoints(records, zone)), nil
+}
+
+// writeConflicts logs every ownership conflict and writes a 409 response.
+// Owner IDs are part of the TXT registry contents and are not logged.
+func writeConflicts(w http.ResponseWriter, logger *slog.Logger, conflicts []registry.Conflict) {
+	for _, c := range conflicts {
+		logger.Warn("ownership conflict", logging.KeyRecordName, c.DNSName, logging.KeyRecordType, c.RecordType)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	resp := conflictResponse{
+		Error:     "records are owned by another external-dns instance",
+		Conflicts: conflicts,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("failed to encode conflict response", logging.KeyError, err)
+	}
+}
@@ -16,70 +16,113 @@ package handler
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/tracing"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
+// StaleHeader lists, in a GET /records response, the zones whose records
+// were served from a stale snapshot; the Age header then carries the age
+// in seconds of the oldest one.
+const StaleHeader = "X-Webhook-Stale-Zones"
+
 // RecordsHandler handles GET /records requests.
-// It retrieves all DNS records from SakuraCloud for the configured zone
-// and returns them as a JSON array.
-func RecordsHandler(client Provider) http.HandlerFunc {
+// It retrieves all DNS records from SakuraCloud for every managed zone
+// and returns them as a single JSON array.
+//
+// A zone whose provider returns records together with a
+// *provider.StaleError is served from that snapshot and reported in
+// StaleHeader instead of failing the request.
+func RecordsHandler(zones *Zones) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		log.Printf("[RecordsHandler] start zone=%s path=%s query=%s",
-			client.GetZoneName(), r.URL.Path, r.URL.RawQuery)
-
-		log.Printf("[RecordsHandler] GET /records invoked")
-
-		records, err := client.ListRecords(r.Context())
-		if err != nil {
-			log.Printf("[RecordsHandler] error listing records: %v", err)
-			http.Error(w, "failed to list DNS records", http.StatusInternalServerError)
-			return
-		}
-
-		zoneSuffix := "." + client.GetZoneName()
+		ctx, span := tracer.Start(r.Context(), "RecordsHandler")
+		defer span.End()
+		logger := logging.FromContext(ctx)
+		logger.Debug("listing records", "zones", zones.Names(), "query", r.URL.RawQuery)
 
 		endpoints := []*endpoint.Endpoint{}
-		for _, rec := range records {
-			fqdn := rec.Name
-			if !strings.HasSuffix(fqdn, zoneSuffix) {
-				fqdn += zoneSuffix
-			}
-
-			epType := rec.Type
-			providerSpecific := []endpoint.ProviderSpecificProperty{}
-			if rec.Type == "ALIAS" {
-				epType = "CNAME"
-				providerSpecific = append(providerSpecific, endpoint.ProviderSpecificProperty{
-					Name:  "alias",
-					Value: "true",
-				})
+		var staleZones []string
+		var staleAge time.Duration
+		for _, zone := range zones.Names() {
+			records, err := zones.Provider(zone).ListRecords(ctx)
+			var stale *provider.StaleError
+			if errors.As(err, &stale) {
+				staleZones = append(staleZones, zone)
+				staleAge = max(staleAge, stale.Age)
+				err = nil
 			}
-
-			ep := &endpoint.Endpoint{
-				DNSName:          fqdn,
-				Targets:          rec.Targets,
-				RecordType:       epType,
-				RecordTTL:        endpoint.TTL(rec.TTL),
-				ProviderSpecific: providerSpecific,
+			if err != nil {
+				logger.Error("failed to list records", logging.KeyZone, zone, logging.KeyError, err)
+				tracing.RecordError(span, err)
+				http.Error(w, "failed to list DNS records", http.StatusInternalServerError)
+				return
 			}
-
-			endpoints = append(endpoints, ep)
+			endpoints = append(endpoints, recordsToEndpoints(records, zone)...)
 		}
 
 		w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		if len(staleZones) > 0 {
+			w.Header().Set(StaleHeader, strings.Join(staleZones, ","))
+			w.Header().Set("Age", strconv.Itoa(int(staleAge.Seconds())))
+		}
 		if err := json.NewEncoder(w).Encode(endpoints); err != nil {
-			log.Printf("[RecordsHandler] error encoding records to JSON: %v", err)
+			logger.Error("failed to encode records", logging.KeyError, err)
 			http.Error(w, "failed to encode records to JSON", http.StatusInternalServerError)
 			return
 		}
 
-		log.Printf("[RecordsHandler] successfully returned %d records (took %s)",
-			len(endpoints), time.Since(start))
+		logger.Info("returned records", "count", len(endpoints), "duration", time.Since(start))
+	}
+}
+
+// recordsToEndpoints converts the records of one zone into endpoints.
+//
+// SakuraCloud stores one record per target, so records sharing a name and
+// type are grouped back into a single endpoint carrying all of their targets.
+// Record names are qualified with provider.FQDN, so "@" is reported as the
+// zone itself. ALIAS records are reported as CNAME with the "alias=true"
+// property.
+func recordsToEndpoints(records []provider.Record, zone string) []*endpoint.Endpoint {
+	endpoints := []*endpoint.Endpoint{}
+	grouped := map[string]*endpoint.Endpoint{}
+	for _, rec := range records {
+		fqdn := provider.FQDN(rec.Name, zone)
+
+		epType := rec.Type
+		providerSpecific := []endpoint.ProviderSpecificProperty{}
+		if rec.Type == "ALIAS" {
+			epType = "CNAME"
+			providerSpecific = append(providerSpecific, endpoint.ProviderSpecificProperty{
+				Name:  "alias",
+				Value: "true",
+			})
+		}
+
+		// Group by (name, type); ALIAS stays apart from a plain CNAME
+		key := fqdn + "/" + rec.Type
+		if ep, ok := grouped[key]; ok {
+			ep.Targets = append(ep.Targets, rec.Targets...)
+			continue
+		}
+
+		ep := &endpoint.Endpoint{
+			DNSName:          fqdn,
+			Targets:          append(endpoint.Targets{}, rec.Targets...),
+			RecordType:       epType,
+			RecordTTL:        endpoint.TTL(rec.TTL),
+			ProviderSpecific: providerSpecific,
+		}
+
+		grouped[key] = ep
+		endpoints = append(endpoints, ep)
 	}
+	return endpoints
 }
@@ -0,0 +1,62 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+)
+
+// validationResponse is the body of a 400 response to a change batch that
+// failed validation.
+type validationResponse struct {
+	Error    string             `json:"error"`
+	Problems []provider.Problem `json:"problems"`
+}
+
+// writeProblems logs every validation problem and writes a 400 response.
+func writeProblems(w http.ResponseWriter, logger *slog.Logger, problems []provider.Problem) {
+	for _, p := range problems {
+		logger.Warn("invalid endpoint", logging.KeyRecordName, p.DNSName, logging.KeyRecordType, p.RecordType,
+			"target", p.Target, "reason", p.Reason)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	resp := validationResponse{
+		Error:    "change batch failed validation",
+		Problems: problems,
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		logger.Error("failed to encode validation response", logging.KeyError, err)
+	}
+}
+
+// endpointProblems returns the problems reported by err, which is nil or,
+// usually, a *provider.ValidationError.
+func endpointProblems(err error) []provider.Problem {
+	if err == nil {
+		return nil
+	}
+	var invalid *provider.ValidationError
+	if errors.As(err, &invalid) {
+		return invalid.Problems
+	}
+	return []provider.Problem{{Reason: err.Error()}}
+}
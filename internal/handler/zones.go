@@ -0,0 +1,101 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Zones holds one Provider per managed DNS zone and routes DNS names
+// to the zone with the longest matching suffix.
+type Zones struct {
+	// AliasApexCNAME makes a CNAME at a zone apex an ALIAS record, which is
+	// what SakuraCloud allows there; when false such CNAMEs are refused.
+	AliasApexCNAME bool
+
+	names     []string // zone names in registration order
+	byLength  []string // zone names ordered longest first for suffix matching
+	providers map[string]Provider
+}
+
+// NewZones builds a Zones router from the given providers, keyed by
+// their GetZoneName(). Later providers for the same zone are ignored.
+func NewZones(providers ...Provider) *Zones {
+	z := &Zones{providers: make(map[string]Provider, len(providers))}
+	for _, p := range providers {
+		name := normalizeZoneName(p.GetZoneName())
+		if _, ok := z.providers[name]; ok {
+			continue
+		}
+		z.providers[name] = p
+		z.names = append(z.names, name)
+	}
+
+	z.byLength = append([]string(nil), z.names...)
+	sort.SliceStable(z.byLength, func(i, j int) bool {
+		return len(z.byLength[i]) > len(z.byLength[j])
+	})
+	return z
+}
+
+// Names returns the managed zone names in registration order.
+func (z *Zones) Names() []string {
+	return append([]string(nil), z.names...)
+}
+
+// Provider returns the Provider registered for the exact zone name.
+func (z *Zones) Provider(zoneName string) Provider {
+	return z.providers[normalizeZoneName(zoneName)]
+}
+
+// Match returns the zone name responsible for dnsName, i.e. the longest
+// zone that equals dnsName or is a dot-separated suffix of it.
+func (z *Zones) Match(dnsName string) (string, bool) {
+	name := normalizeZoneName(dnsName)
+	for _, zone := range z.byLength {
+		if name == zone || strings.HasSuffix(name, "."+zone) {
+			return zone, true
+		}
+	}
+	return "", false
+}
+
+// splitByZone groups endpoints by the zone they belong to.
+// Endpoints that match no managed zone are logged and dropped.
+func (z *Zones) splitByZone(ctx context.Context, endpoints []*endpoint.Endpoint) map[string][]*endpoint.Endpoint {
+	out := make(map[string][]*endpoint.Endpoint, len(z.names))
+	for _, e := range endpoints {
+		if e == nil {
+			continue
+		}
+		zone, ok := z.Match(e.DNSName)
+		if !ok {
+			logging.FromContext(ctx).Warn("no managed zone for endpoint, skipping",
+				logging.KeyRecordName, e.DNSName, logging.KeyRecordType, e.RecordType)
+			continue
+		}
+		out[zone] = append(out[zone], e)
+	}
+	return out
+}
+
+func normalizeZoneName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,41 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	sw := NewStatusWriter(rr)
+	if got := sw.Status(); got != http.StatusOK {
+		t.Errorf("Status() before writing = %d; want 200", got)
+	}
+	if NewStatusWriter(sw) != sw {
+		t.Error("NewStatusWriter() wrapped a StatusWriter again")
+	}
+
+	sw.WriteHeader(http.StatusConflict)
+	sw.WriteHeader(http.StatusInternalServerError)
+	if got := sw.Status(); got != http.StatusConflict {
+		t.Errorf("Status() = %d; want the first status 409", got)
+	}
+	if rr.Code != http.StatusConflict {
+		t.Errorf("recorded status = %d; want 409", rr.Code)
+	}
+}
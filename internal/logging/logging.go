@@ -0,0 +1,156 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package logging configures the structured slog logger used by the webhook
+// and keeps TXT registry contents and credentials out of the logs.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Attribute keys shared by every package, so that log lines about the same
+// zone, request or record can be correlated.
+const (
+	KeyZone       = "zone"
+	KeyRoute      = "route"
+	KeyRequestID  = "request_id"
+	KeyRecordName = "record_name"
+	KeyRecordType = "record_type"
+	KeyError      = "error"
+	KeyTraceID    = "trace_id"
+)
+
+// RequestIDHeader carries the request id; an incoming value is reused.
+const RequestIDHeader = "X-Request-Id"
+
+const redacted = "[REDACTED]"
+
+var (
+	// registryTXT matches the content of an external-dns TXT registry record.
+	registryTXT = regexp.MustCompile(`heritage=external-dns[^"\\\s]*`)
+	// credentialPair matches key/value pairs whose key looks like a credential.
+	credentialPair = regexp.MustCompile(`(?i)((?:access[_-]?)?token|secret|password|passwd|api[_-]?key|authorization)(["']?\s*[:=]\s*["']?)(?:(?:bearer|basic)\s+)?[^\s"',&]+`)
+	// sensitiveKey matches attribute keys whose values are always redacted.
+	sensitiveKey = regexp.MustCompile(`(?i)token|secret|password|passwd|api[_-]?key|authorization|credential`)
+)
+
+// ParseLevel converts "debug", "info", "warn" or "error" to a slog.Level.
+func ParseLevel(s string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(strings.TrimSpace(s))); err != nil {
+		return 0, fmt.Errorf("invalid log level %q: %w", s, err)
+	}
+	return level, nil
+}
+
+// New returns a logger writing to w at the given level, as "text" or "json".
+// Every attribute passes through Redact.
+func New(w io.Writer, level, format string) (*slog.Logger, error) {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redactAttr}
+
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: must be text or json", format)
+	}
+}
+
+// Redact masks TXT registry contents and credential-looking key/value pairs in s.
+func Redact(s string) string {
+	s = registryTXT.ReplaceAllString(s, redacted)
+	return credentialPair.ReplaceAllString(s, "${1}${2}"+redacted)
+}
+
+// redactAttr is the slog ReplaceAttr hook applied to every attribute.
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	if sensitiveKey.MatchString(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch v := a.Value.Any().(type) {
+	case string:
+		return slog.String(a.Key, Redact(v))
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = Redact(s)
+		}
+		return slog.Any(a.Key, out)
+	case error:
+		return slog.String(a.Key, Redact(v.Error()))
+	}
+	return a
+}
+
+type ctxKey struct{}
+
+// WithLogger returns a copy of ctx carrying l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, l)
+}
+
+// FromContext returns the logger carried by ctx, or slog.Default().
+func FromContext(ctx context.Context) *slog.Logger {
+	if ctx != nil {
+		if l, ok := ctx.Value(ctxKey{}).(*slog.Logger); ok {
+			return l
+		}
+	}
+	return slog.Default()
+}
+
+// Middleware attaches a logger carrying the route, a request id and the
+// trace id of the current span, if any, to the request context, and echoes
+// the request id in the response headers.
+func Middleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		l := FromContext(r.Context()).With(KeyRoute, route, KeyRequestID, id)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			l = l.With(KeyTraceID, sc.TraceID().String())
+		}
+		l.Debug("request received", "method", r.Method, "path", r.URL.Path)
+		next(w, r.WithContext(WithLogger(r.Context(), l)))
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
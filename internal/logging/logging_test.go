@@ -0,0 +1,144 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		level, format string
+		wantErr       bool
+	}{
+		{"info", "text", false},
+		{"DEBUG", "json", false},
+		{"warn", "", false},
+		{"verbose", "text", true},
+		{"info", "xml", true},
+	}
+	for _, tt := range tests {
+		_, err := New(&bytes.Buffer{}, tt.level, tt.format)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("New(%q, %q) error = %v; wantErr %v", tt.level, tt.format, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNew_LevelAndJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "info", "json")
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	logger.Debug("hidden")
+	logger.Info("shown", KeyZone, "example.com")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("got %d log lines; want 1: %q", len(lines), buf.String())
+	}
+	var entry map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v", err)
+	}
+	if entry["msg"] != "shown" || entry[KeyZone] != "example.com" {
+		t.Errorf("entry = %v; want msg=shown zone=example.com", entry)
+	}
+}
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{
+			in:   `"heritage=external-dns,external-dns/owner=default,external-dns/resource=ingress/default/app"`,
+			want: `"[REDACTED]"`,
+		},
+		{
+			in:   `{"targets":["\"heritage=external-dns,external-dns/owner=default\""]}`,
+			want: `{"targets":["\"[REDACTED]\""]}`,
+		},
+		{in: "token=abc123 zone=example.com", want: "token=[REDACTED] zone=example.com"},
+		{in: `{"api_key": "s3cr3t"}`, want: `{"api_key": "[REDACTED]"}`},
+		{in: "Authorization: Bearer abc.def", want: "Authorization: [REDACTED]"},
+		{in: "v=spf1 include:example.com ~all", want: "v=spf1 include:example.com ~all"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNew_RedactsAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, "debug", "text")
+	if err != nil {
+		t.Fatalf("New() unexpected error: %v", err)
+	}
+	logger.Info("test",
+		"sakura_api_secret", "plain-secret",
+		"targets", []string{"heritage=external-dns,external-dns/owner=me", "1.2.3.4"},
+		KeyError, errors.New("request failed: token=abc"),
+	)
+
+	out := buf.String()
+	for _, leaked := range []string{"plain-secret", "owner=me", "token=abc"} {
+		if strings.Contains(out, leaked) {
+			t.Errorf("log output leaks %q: %s", leaked, out)
+		}
+	}
+	if !strings.Contains(out, "1.2.3.4") {
+		t.Errorf("log output lost a non-sensitive target: %s", out)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	base := slog.New(slog.NewTextHandler(&buf, nil))
+
+	h := Middleware("/records", func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context()).Info("handled")
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/records", nil)
+	req = req.WithContext(WithLogger(req.Context(), base))
+	req.Header.Set(RequestIDHeader, "req-1")
+	rr := httptest.NewRecorder()
+	h(rr, req)
+
+	if got := rr.Header().Get(RequestIDHeader); got != "req-1" {
+		t.Errorf("response %s = %q; want req-1", RequestIDHeader, got)
+	}
+	out := buf.String()
+	if !strings.Contains(out, "route=/records") || !strings.Contains(out, "request_id=req-1") {
+		t.Errorf("log output lacks route/request_id: %s", out)
+	}
+
+	// Without an incoming id one is generated
+	rr = httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodGet, "/records", nil))
+	if rr.Header().Get(RequestIDHeader) == "" {
+		t.Error("no request id was generated")
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics defines the Prometheus metrics exposed by the webhook.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/httputil"
+)
+
+const namespace = "sacloud_webhook"
+
+// Registry holds every webhook metric together with the Go runtime and
+// process collectors. It is served by Handler.
+var Registry = prometheus.NewRegistry()
+
+var (
+	// HTTPRequests counts webhook requests by route, method and status code.
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of webhook HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPDuration observes webhook request latencies by route and method.
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of webhook HTTP requests by route and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	// APICalls counts SakuraCloud DNS API calls by operation (find, read, update).
+	APICalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sakuracloud_api_calls_total",
+		Help:      "Number of SakuraCloud DNS API calls by operation.",
+	}, []string{"operation"})
+
+	// APIErrors counts failed SakuraCloud DNS API calls by operation.
+	APIErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sakuracloud_api_errors_total",
+		Help:      "Number of failed SakuraCloud DNS API calls by operation.",
+	}, []string{"operation"})
+
+	// APIDuration observes SakuraCloud DNS API call latencies by operation.
+	APIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sakuracloud_api_call_duration_seconds",
+		Help:      "Latency of SakuraCloud DNS API calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	// APIRetries counts retried SakuraCloud DNS API calls by operation and
+	// reason (rate_limited, server_error, timeout).
+	APIRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sakuracloud_api_retries_total",
+		Help:      "Number of retried SakuraCloud DNS API calls by operation and reason.",
+	}, []string{"operation", "reason"})
+
+	// Applies counts ApplyChanges calls that reached the zone by result
+	// (success, error, dry_run).
+	Applies = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "applies_total",
+		Help:      "Number of zone updates by zone and result.",
+	}, []string{"zone", "result"})
+
+	// ApplyQueueWait observes how long ApplyChanges calls waited for the
+	// zone's apply queue before reading the zone.
+	ApplyQueueWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "apply_queue_wait_seconds",
+		Help:      "Time zone updates waited for earlier updates of the same zone.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"zone"})
+
+	// RecordsCreated counts SakuraCloud records added by successful applies.
+	RecordsCreated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_created_total",
+		Help:      "Number of DNS records created by zone.",
+	}, []string{"zone"})
+
+	// RecordsDeleted counts SakuraCloud records removed by successful applies.
+	RecordsDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_deleted_total",
+		Help:      "Number of DNS records deleted by zone.",
+	}, []string{"zone"})
+
+	// ZoneRecords is the number of records last seen in each zone.
+	ZoneRecords = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "zone_records",
+		Help:      "Number of DNS records in the zone as of the last read or update.",
+	}, []string{"zone"})
+
+	// CacheHits counts GET /records zone reads served from the in-memory cache.
+	CacheHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_cache_hits_total",
+		Help:      "Number of zone record listings served from the cache.",
+	}, []string{"zone"})
+
+	// CacheMisses counts zone record listings that had to read the zone.
+	CacheMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "records_cache_misses_total",
+		Help:      "Number of zone record listings that read the zone from the API.",
+	}, []string{"zone"})
+
+	// DeletionsRefused counts zone updates refused for deleting more records
+	// than the configured limits allow.
+	DeletionsRefused = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deletions_refused_total",
+		Help:      "Number of zone updates refused by the deletion limits.",
+	}, []string{"zone"})
+
+	// StaleServes counts zone record listings served from a stale snapshot
+	// because the zone could not be read.
+	StaleServes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "stale_records_served_total",
+		Help:      "Number of zone record listings served from a stale snapshot during API errors.",
+	}, []string{"zone"})
+
+	// LastSync is the Unix time of the last successful read or update of a zone.
+	LastSync = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last successful read or update of the zone.",
+	}, []string{"zone"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests, HTTPDuration,
+		APICalls, APIErrors, APIDuration, APIRetries,
+		Applies, ApplyQueueWait, RecordsCreated, RecordsDeleted, DeletionsRefused,
+		ZoneRecords, LastSync,
+		CacheHits, CacheMisses, StaleServes,
+	)
+}
+
+// Handler serves the metrics in Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveAPICall records one SakuraCloud DNS API call that started at start.
+func ObserveAPICall(operation string, start time.Time, err error) {
+	APICalls.WithLabelValues(operation).Inc()
+	APIDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		APIErrors.WithLabelValues(operation).Inc()
+	}
+}
+
+// ObserveSync records a successful read or update of zone holding n records.
+func ObserveSync(zone string, n int) {
+	ZoneRecords.WithLabelValues(zone).Set(float64(n))
+	LastSync.WithLabelValues(zone).SetToCurrentTime()
+}
+
+// InstrumentRoute wraps next so that its requests are counted and timed
+// under the fixed route label.
+func InstrumentRoute(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := httputil.NewStatusWriter(w)
+		next(sw, r)
+		HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(sw.Status())).Inc()
+		HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+}
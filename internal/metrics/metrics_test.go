@@ -0,0 +1,72 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentRoute(t *testing.T) {
+	h := InstrumentRoute("/test", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusTeapot)
+	})
+
+	before := testutil.ToFloat64(HTTPRequests.WithLabelValues("/test", http.MethodGet, "418"))
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test", nil))
+	after := testutil.ToFloat64(HTTPRequests.WithLabelValues("/test", http.MethodGet, "418"))
+	if after-before != 1 {
+		t.Errorf("requests counter increased by %v; want 1", after-before)
+	}
+}
+
+func TestInstrumentRoute_DefaultStatus(t *testing.T) {
+	h := InstrumentRoute("/ok", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/ok", nil))
+	if got := testutil.ToFloat64(HTTPRequests.WithLabelValues("/ok", http.MethodPost, "200")); got != 1 {
+		t.Errorf("requests{code=200} = %v; want 1", got)
+	}
+}
+
+func TestObserveAPICall(t *testing.T) {
+	ObserveAPICall("test-op", time.Now(), nil)
+	ObserveAPICall("test-op", time.Now(), errors.New("boom"))
+
+	if got := testutil.ToFloat64(APICalls.WithLabelValues("test-op")); got != 2 {
+		t.Errorf("api calls = %v; want 2", got)
+	}
+	if got := testutil.ToFloat64(APIErrors.WithLabelValues("test-op")); got != 1 {
+		t.Errorf("api errors = %v; want 1", got)
+	}
+}
+
+func TestObserveSync(t *testing.T) {
+	ObserveSync("sync.example", 7)
+
+	if got := testutil.ToFloat64(ZoneRecords.WithLabelValues("sync.example")); got != 7 {
+		t.Errorf("zone records = %v; want 7", got)
+	}
+	if got := testutil.ToFloat64(LastSync.WithLabelValues("sync.example")); got == 0 {
+		t.Error("last sync timestamp was not set")
+	}
+}
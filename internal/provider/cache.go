@@ -0,0 +1,148 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	iaas "github.com/sacloud/iaas-api-go"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
+)
+
+// CacheStats reports how ListRecords calls for a zone were served.
+type CacheStats struct {
+	Hits   uint64        // calls served from the cached zone
+	Misses uint64        // calls that read the zone from the API
+	Age    time.Duration // age of the cached zone; zero when empty
+}
+
+// StaleError is returned by ListRecords, together with the last records
+// read successfully, when the zone cannot be read but a snapshot younger
+// than StaleWindow exists. Callers that must not act on stale data treat it
+// like any other error.
+type StaleError struct {
+	Zone string        // zone the snapshot belongs to
+	Age  time.Duration // age of the snapshot
+	Err  error         // error of the failed read
+}
+
+func (e *StaleError) Error() string {
+	return fmt.Sprintf("zone %s: serving records from %s ago: %v", e.Zone, e.Age.Round(time.Second), e.Err)
+}
+
+func (e *StaleError) Unwrap() error {
+	return e.Err
+}
+
+// zoneCache holds the records of one zone as last read or written.
+// The zero value is empty.
+type zoneCache struct {
+	mu      sync.Mutex
+	records []*iaas.DNSRecord
+	fetched time.Time
+	valid   bool   // false once invalidated; records are then only served stale
+	gen     uint64 // bumped by every store or invalidate
+	hits    uint64
+	misses  uint64
+}
+
+// get returns the cached records if they are younger than ttl. Otherwise it
+// counts a miss and returns the generation to pass to storeIfCurrent.
+func (zc *zoneCache) get(zone string, ttl time.Duration) ([]*iaas.DNSRecord, uint64, bool) {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	if zc.valid && time.Since(zc.fetched) < ttl {
+		zc.hits++
+		metrics.CacheHits.WithLabelValues(zone).Inc()
+		return zc.records, zc.gen, true
+	}
+	zc.misses++
+	metrics.CacheMisses.WithLabelValues(zone).Inc()
+	return nil, zc.gen, false
+}
+
+// generation returns the current generation to pass to storeIfCurrent.
+func (zc *zoneCache) generation() uint64 {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	return zc.gen
+}
+
+// storeIfCurrent caches records read from the API, unless the cache was
+// refreshed or invalidated since gen was obtained, e.g. by an ApplyChanges
+// that finished while the read was in flight.
+func (zc *zoneCache) storeIfCurrent(gen uint64, records []*iaas.DNSRecord) {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	if zc.gen != gen {
+		return
+	}
+	zc.gen++
+	zc.records = records
+	zc.fetched = time.Now()
+	zc.valid = true
+}
+
+// store replaces the cached records with the ones just written.
+func (zc *zoneCache) store(records []*iaas.DNSRecord) {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	zc.gen++
+	zc.records = records
+	zc.fetched = time.Now()
+	zc.valid = true
+}
+
+// invalidate stops serving the cached records as fresh. They are kept as
+// the last known snapshot for stale serving.
+func (zc *zoneCache) invalidate() {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	zc.gen++
+	zc.valid = false
+}
+
+// stale returns the last known snapshot and its age, if it is younger
+// than window.
+func (zc *zoneCache) stale(window time.Duration) ([]*iaas.DNSRecord, time.Duration, bool) {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	if zc.fetched.IsZero() {
+		return nil, 0, false
+	}
+	age := time.Since(zc.fetched)
+	if age >= window {
+		return nil, age, false
+	}
+	return zc.records, age, true
+}
+
+func (zc *zoneCache) snapshot() CacheStats {
+	zc.mu.Lock()
+	defer zc.mu.Unlock()
+	stats := CacheStats{Hits: zc.hits, Misses: zc.misses}
+	if zc.valid {
+		stats.Age = time.Since(zc.fetched)
+	}
+	return stats
+}
+
+// CacheStats returns the ListRecords cache statistics of the zone.
+func (c *Client) CacheStats() CacheStats {
+	return c.cache.snapshot()
+}
@@ -17,12 +17,18 @@ package provider
 import (
 	"context"
 	"errors"
-	"log"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
 
 	client "github.com/sacloud/api-client-go"
 	iaas "github.com/sacloud/iaas-api-go"
 	"github.com/sacloud/iaas-api-go/types"
 	"github.com/sacloud/iaas-service-go/dns"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
 )
 
 // ErrZoneNotFound is returned when the specified DNS zone cannot be found
@@ -30,10 +36,51 @@ var ErrZoneNotFound = errors.New("zone not found")
 
 // Client manages DNS records for a specific SakuraCloud DNS zone
 type Client struct {
-	Context        context.Context // base context for API calls
-	Service        DNSService      // underlying SakuraCloud DNS service
-	ZoneName       string          // DNS zone name, e.g. "example.com"
-	ZoneID         types.ID        // SakuraCloud DNS zone ID
+	Context  context.Context // base context for API calls
+	Service  DNSService      // underlying SakuraCloud DNS service
+	ZoneName string          // DNS zone name, e.g. "example.com"
+	ZoneID   types.ID        // SakuraCloud DNS zone ID
+
+	// Optimistic-concurrency retry settings for ApplyChanges; zero values
+	// fall back to DefaultConflictRetries and DefaultConflictBackoff.
+	ConflictRetries int
+	ConflictBackoff time.Duration
+
+	// DryRun makes ApplyChanges compute and log the new record set without
+	// calling UpdateWithContext; ListRecords keeps reading live data.
+	DryRun bool
+
+	// HealthMaxAge is how long Health trusts the last API outcome before
+	// probing again; zero falls back to DefaultHealthMaxAge.
+	HealthMaxAge time.Duration
+
+	// CacheTTL is how long ListRecords serves the zone from memory before
+	// reading it again; zero disables the cache. A successful ApplyChanges
+	// refreshes the cache with the records it wrote.
+	CacheTTL time.Duration
+
+	// StaleWindow lets ListRecords fall back to the last records read or
+	// written when the zone cannot be read, as long as they are younger
+	// than the window; zero disables stale serving.
+	StaleWindow time.Duration
+
+	// MaxDeletions and MaxDeletionPercent refuse an update that deletes more
+	// records, or a larger share of the zone, with ErrDeletionLimit; zero
+	// disables a limit. AllowMassDeletion only logs such updates.
+	MaxDeletions       int
+	MaxDeletionPercent float64
+	AllowMassDeletion  bool
+
+	// ProtectRules match records ApplyChanges refuses to create, delete or
+	// overwrite with ErrProtectedRecord. HideProtected also leaves them out
+	// of ListRecords.
+	ProtectRules  []ProtectRule
+	HideProtected bool
+
+	queue    applyQueue    // serializes ApplyChanges for this zone
+	lastDiff lastDiff      // diff of the most recent ApplyChanges
+	health   healthTracker // outcome of recent API calls for this zone
+	cache    zoneCache     // records served by ListRecords within CacheTTL
 }
 
 // DNSService defines the methods used from the SakuraCloud DNS API
@@ -45,52 +92,71 @@ type DNSService interface {
 }
 
 // NewClient initializes a SakuraCloud DNS client for the given zoneName
-// token and secret must be provided. It also sets a default
-// RequestTimeout of 10 seconds for API calls.
+// token and secret must be provided. API calls use the default timeout,
+// rate limit and retry policy of APIOptions.
 func NewClient(zoneName, token, secret string) (*Client, error) {
-	log.Printf("Initializing SakuraCloud DNS client for zone '%s'", zoneName)
+	clients, err := NewClients([]string{zoneName}, token, secret, APIOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return clients[zoneName], nil
+}
 
+// NewClients initializes one SakuraCloud DNS client per zone name, sharing a
+// single API client. The returned map is keyed by zone name. All zones must
+// exist in the account, otherwise ErrZoneNotFound is returned.
+//
+// All calls share the token bucket and retry policy of api; the retries of
+// the SakuraCloud HTTP client itself are disabled in favour of them.
+func NewClients(zoneNames []string, token, secret string, api APIOptions) (map[string]*Client, error) {
+	logger := slog.Default()
+	logger.Info("initializing SakuraCloud DNS clients", "zones", zoneNames)
+
+	api = api.withDefaults()
 	opts := &client.Options{
-		AccessToken:       token,
-		AccessTokenSecret: secret,
-		HttpRequestTimeout: 30,
-		RetryWaitMax: 1,
+		AccessToken:        token,
+		AccessTokenSecret:  secret,
+		HttpClient:         newHTTPClient(),
+		HttpRequestTimeout: int(math.Ceil(api.Timeout.Seconds())),
+		// Throttle does the rate limiting; this only keeps the client's
+		// own limiter, which ignores cancellation, out of the way.
+		HttpRequestRateLimit: int(math.Ceil(api.RateLimit)) + api.Burst,
+		CheckRetryFunc: func(ctx context.Context, _ *http.Response, _ error) (bool, error) {
+			return false, ctx.Err()
+		},
 	}
 	apiClient := iaas.NewClientWithOptions(opts)
-	log.Printf("SakuraCloud API client created with provided token, secret, and timeout")
-
-	svc := dns.New(apiClient)
-	log.Printf("SakuraCloud DNS service instance ready")
 
-	log.Printf("Searching for DNS zone '%s'", zoneName)
-	zones, err := svc.Find(&dns.FindRequest{})
+	svc := Throttle(Instrument(dns.New(apiClient)), api)
+	zones, err := svc.FindWithContext(context.Background(), &dns.FindRequest{})
 	if err != nil {
-		log.Printf("Error finding DNS zones: %v", err)
+		logger.Error("failed to find DNS zones", logging.KeyError, err)
 		return nil, err
 	}
 
-	var zoneID types.ID
+	zoneIDs := make(map[string]types.ID, len(zones))
 	for _, z := range zones {
-		log.Printf("Found zone: %s (ID: %d)", z.Name, z.ID)
-		if z.Name == zoneName {
-			zoneID = z.ID
-			log.Printf("Matched target zone '%s' with ID %d", zoneName, zoneID)
-			break
-		}
-	}
-	if zoneID == 0 {
-		log.Printf("Zone '%s' not found among %d zones", zoneName, len(zones))
-		return nil, ErrZoneNotFound
+		logger.Debug("found zone", logging.KeyZone, z.Name, "zone_id", z.ID)
+		zoneIDs[z.Name] = z.ID
 	}
 
-	client := &Client{
-		Context:        context.Background(),
-		Service:        svc,
-		ZoneName:       zoneName,
-		ZoneID:         zoneID,
+	clients := make(map[string]*Client, len(zoneNames))
+	for _, zoneName := range zoneNames {
+		zoneID, ok := zoneIDs[zoneName]
+		if !ok {
+			logger.Error("zone not found", logging.KeyZone, zoneName, "zones_found", len(zones))
+			return nil, fmt.Errorf("%w: %s", ErrZoneNotFound, zoneName)
+		}
+
+		clients[zoneName] = &Client{
+			Context:  context.Background(),
+			Service:  svc,
+			ZoneName: zoneName,
+			ZoneID:   zoneID,
+		}
+		logger.Info("zone client initialized", logging.KeyZone, zoneName, "zone_id", zoneID)
 	}
-	log.Printf("Client for zone '%s' initialized successfully within http request timeout limit", zoneName)
-	return client, nil
+	return clients, nil
 }
 
 func (c *Client) GetZoneName() string {
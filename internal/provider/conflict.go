@@ -0,0 +1,129 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	iaas "github.com/sacloud/iaas-api-go"
+)
+
+const (
+	// DefaultConflictRetries is how many times ApplyChanges re-applies its
+	// intent after the zone was modified concurrently.
+	DefaultConflictRetries = 3
+	// DefaultConflictBackoff is the wait before the first retry; it doubles
+	// on every further attempt.
+	DefaultConflictBackoff = 500 * time.Millisecond
+)
+
+// ErrIntentConflict is returned when a concurrent change to the zone makes
+// the requested create/delete intent impossible to apply as planned.
+var ErrIntentConflict = errors.New("change conflicts with concurrent zone modification")
+
+// conflictPolicy returns the retry count and initial backoff for c.
+func (c *Client) conflictPolicy() (int, time.Duration) {
+	retries, backoff := c.ConflictRetries, c.ConflictBackoff
+	if retries <= 0 {
+		retries = DefaultConflictRetries
+	}
+	if backoff <= 0 {
+		backoff = DefaultConflictBackoff
+	}
+	return retries, backoff
+}
+
+// isConflictError reports whether err is SakuraCloud rejecting an update
+// because the zone's SettingsHash no longer matches.
+func isConflictError(err error) bool {
+	var apiErr iaas.APIError
+	return errors.As(err, &apiErr) &&
+		apiErr.ResponseCode() == http.StatusConflict &&
+		apiErr.Code() != "still_creating"
+}
+
+// checkIntent verifies that create and del still make sense against the
+// freshly read records of a zone that was modified concurrently.
+//
+// A delete whose record is already gone is fine, unless an unexpected value
+// now exists for the same name and type: someone replaced what we meant to
+// remove. A CNAME or ALIAS create conflicts with a different target that
+// appeared at the same name and is not being deleted.
+func checkIntent(current []*iaas.DNSRecord, create, del []Record) error {
+	var problems []string
+
+	for _, dRec := range del {
+		for _, target := range dRec.Targets {
+			if anyMatches(current, Record{Type: dRec.Type, Name: dRec.Name, Targets: []string{target}}) {
+				continue
+			}
+			for _, rs := range current {
+				if string(rs.Type) != dRec.Type || !strings.EqualFold(rs.Name, dRec.Name) {
+					continue
+				}
+				if isPlanned(del, rs) || isPlanned(create, rs) {
+					continue
+				}
+				problems = append(problems, fmt.Sprintf("%s %s -> %s was replaced by %s",
+					dRec.Type, dRec.Name, target, rs.RData))
+			}
+		}
+	}
+
+	for _, cRec := range create {
+		if cRec.Type != "CNAME" && cRec.Type != "ALIAS" {
+			continue
+		}
+		for _, rs := range current {
+			if !strings.EqualFold(rs.Name, cRec.Name) || (string(rs.Type) != "CNAME" && string(rs.Type) != "ALIAS") {
+				continue
+			}
+			if recordMatches(rs, cRec) || isPlanned(del, rs) {
+				continue
+			}
+			problems = append(problems, fmt.Sprintf("%s %s already points to %s",
+				rs.Type, rs.Name, rs.RData))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrIntentConflict, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// anyMatches reports whether any record of current is described by rec.
+func anyMatches(current []*iaas.DNSRecord, rec Record) bool {
+	for _, rs := range current {
+		if recordMatches(rs, rec) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPlanned reports whether rs is described by any of recs.
+func isPlanned(recs []Record, rs *iaas.DNSRecord) bool {
+	for _, rec := range recs {
+		if recordMatches(rs, rec) {
+			return true
+		}
+	}
+	return false
+}
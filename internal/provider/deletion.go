@@ -0,0 +1,71 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
+)
+
+// ErrDeletionLimit is returned when an update would delete more records than
+// MaxDeletions or MaxDeletionPercent allow and AllowMassDeletion is off.
+var ErrDeletionLimit = errors.New("deletion limit exceeded")
+
+// checkDeletions enforces the deletion limits of c on diff, whose Removed and
+// Unchanged records make up the zone before the update. Removed records
+// replaced by an added record of the same name and type are updates, not
+// deletions, and are not counted.
+func (c *Client) checkDeletions(logger *slog.Logger, diff ZoneDiff) error {
+	if c.MaxDeletions <= 0 && c.MaxDeletionPercent <= 0 {
+		return nil
+	}
+
+	replaced := map[string]bool{}
+	for _, rs := range diff.Added {
+		replaced[string(rs.Type)+"|"+strings.ToLower(rs.Name)] = true
+	}
+	deletions := 0
+	for _, rs := range diff.Removed {
+		if !replaced[string(rs.Type)+"|"+strings.ToLower(rs.Name)] {
+			deletions++
+		}
+	}
+	total := len(diff.Removed) + len(diff.Unchanged)
+
+	var exceeded string
+	switch {
+	case c.MaxDeletions > 0 && deletions > c.MaxDeletions:
+		exceeded = fmt.Sprintf("%d records", c.MaxDeletions)
+	case c.MaxDeletionPercent > 0 && total > 0 && float64(deletions)*100 > c.MaxDeletionPercent*float64(total):
+		exceeded = fmt.Sprintf("%g%% of the zone", c.MaxDeletionPercent)
+	default:
+		return nil
+	}
+
+	if c.AllowMassDeletion {
+		logger.Warn("deletion limit exceeded, applying anyway as mass deletion is allowed",
+			"deletions", deletions, "records", total, "limit", exceeded)
+		return nil
+	}
+	metrics.DeletionsRefused.WithLabelValues(c.ZoneName).Inc()
+	logger.Error("refusing update above the deletion limit",
+		"deletions", deletions, "records", total, "limit", exceeded)
+	return fmt.Errorf("%w: update would delete %d of %d records in zone %s, more than %s",
+		ErrDeletionLimit, deletions, total, c.ZoneName, exceeded)
+}
@@ -0,0 +1,119 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	iaas "github.com/sacloud/iaas-api-go"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+)
+
+// ZoneDiff describes how a zone update changes the record set of a zone.
+// A record whose TTL changes is reported as removed and added.
+type ZoneDiff struct {
+	Zone      string            `json:"zone"`
+	DryRun    bool              `json:"dryRun"`
+	Time      time.Time         `json:"time"`
+	Added     []*iaas.DNSRecord `json:"added"`
+	Removed   []*iaas.DNSRecord `json:"removed"`
+	Unchanged []*iaas.DNSRecord `json:"unchanged"`
+}
+
+// diffRecords compares the record set before and after an update.
+func diffRecords(before, after []*iaas.DNSRecord) ZoneDiff {
+	diff := ZoneDiff{
+		Added:     []*iaas.DNSRecord{},
+		Removed:   []*iaas.DNSRecord{},
+		Unchanged: []*iaas.DNSRecord{},
+	}
+
+	remaining := map[string]int{}
+	for _, rs := range after {
+		remaining[recordKey(rs)]++
+	}
+	for _, rs := range before {
+		key := recordKey(rs)
+		if remaining[key] > 0 {
+			remaining[key]--
+			diff.Unchanged = append(diff.Unchanged, rs)
+			continue
+		}
+		diff.Removed = append(diff.Removed, rs)
+	}
+
+	existing := map[string]int{}
+	for _, rs := range before {
+		existing[recordKey(rs)]++
+	}
+	for _, rs := range after {
+		key := recordKey(rs)
+		if existing[key] > 0 {
+			existing[key]--
+			continue
+		}
+		diff.Added = append(diff.Added, rs)
+	}
+	return diff
+}
+
+// recordKey identifies a record by type, name, canonical RData and TTL.
+func recordKey(rs *iaas.DNSRecord) string {
+	return fmt.Sprintf("%s|%s|%s|%d", rs.Type, strings.ToLower(rs.Name), canonicalRData(string(rs.Type), rs.RData), rs.TTL)
+}
+
+// logDiff logs a summary of diff and, per added and removed record, its
+// name and type. Record data is only logged at debug level.
+func logDiff(logger *slog.Logger, diff ZoneDiff) {
+	logger.Info("planned zone update", "dry_run", diff.DryRun,
+		"added", len(diff.Added), "removed", len(diff.Removed), "unchanged", len(diff.Unchanged))
+	for _, rs := range diff.Added {
+		logger.Info("record added", logging.KeyRecordName, rs.Name, logging.KeyRecordType, string(rs.Type), "dry_run", diff.DryRun)
+		logger.Debug("record added data", logging.KeyRecordName, rs.Name, "rdata", rs.RData, "ttl", rs.TTL)
+	}
+	for _, rs := range diff.Removed {
+		logger.Info("record removed", logging.KeyRecordName, rs.Name, logging.KeyRecordType, string(rs.Type), "dry_run", diff.DryRun)
+		logger.Debug("record removed data", logging.KeyRecordName, rs.Name, "rdata", rs.RData, "ttl", rs.TTL)
+	}
+}
+
+// lastDiff holds the most recent ZoneDiff computed by ApplyChanges.
+type lastDiff struct {
+	mu   sync.Mutex
+	diff *ZoneDiff
+}
+
+func (l *lastDiff) set(d ZoneDiff) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.diff = &d
+}
+
+func (l *lastDiff) get() *ZoneDiff {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.diff
+}
+
+// LastDiff returns the diff computed by the most recent ApplyChanges call
+// that reached the zone, or nil if there has been none.
+func (c *Client) LastDiff() *ZoneDiff {
+	return c.lastDiff.get()
+}
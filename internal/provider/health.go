@@ -0,0 +1,120 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sacloud/iaas-service-go/dns"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+)
+
+// DefaultHealthMaxAge is how long the outcome of the last API call is
+// trusted before Health probes the zone again.
+const DefaultHealthMaxAge = 30 * time.Second
+
+// ZoneHealth reports whether the SakuraCloud API could recently be used
+// to read or write a zone.
+type ZoneHealth struct {
+	Zone          string     `json:"zone"`
+	Ready         bool       `json:"ready"`
+	LastSuccess   *time.Time `json:"lastSuccess,omitempty"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorTime *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// healthTracker records the outcome of the SakuraCloud API calls of one zone.
+// The zero value has observed nothing yet.
+type healthTracker struct {
+	mu        sync.Mutex
+	probe     sync.Mutex // at most one probe per zone at a time
+	observed  time.Time
+	ok        bool
+	lastOK    time.Time
+	lastErr   error
+	lastErrAt time.Time
+}
+
+// observe records the outcome of an API call. Conflicts prove that the API
+// is reachable and count as success; cancelled calls say nothing about it.
+func (h *healthTracker) observe(err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	now := time.Now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observed = now
+	if err == nil || isConflictError(err) {
+		h.ok = true
+		h.lastOK = now
+		return
+	}
+	h.ok = false
+	h.lastErr = err
+	h.lastErrAt = now
+}
+
+// fresh reports whether an outcome was observed within maxAge.
+func (h *healthTracker) fresh(maxAge time.Duration) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.observed.IsZero() && time.Since(h.observed) < maxAge
+}
+
+func (h *healthTracker) snapshot(zone string) ZoneHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	zh := ZoneHealth{Zone: zone, Ready: h.ok}
+	if !h.lastOK.IsZero() {
+		t := h.lastOK
+		zh.LastSuccess = &t
+	}
+	if h.lastErr != nil {
+		t := h.lastErrAt
+		zh.LastError = h.lastErr.Error()
+		zh.LastErrorTime = &t
+	}
+	return zh
+}
+
+// Health reports whether the zone can currently be read or written. It is
+// based on the outcome of recent ListRecords and ApplyChanges calls; only
+// when none happened within HealthMaxAge (DefaultHealthMaxAge if zero) is
+// the zone read once to refresh it, so frequent probes do not reach the API.
+func (c *Client) Health(ctx context.Context) ZoneHealth {
+	maxAge := c.HealthMaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultHealthMaxAge
+	}
+
+	if !c.health.fresh(maxAge) {
+		c.health.probe.Lock()
+		// Another caller may have refreshed the outcome while we waited
+		if !c.health.fresh(maxAge) {
+			_, err := c.Service.ReadWithContext(ctx, &dns.ReadRequest{ID: c.ZoneID})
+			if err != nil {
+				logging.FromContext(ctx).Warn("health probe failed", logging.KeyZone, c.ZoneName, logging.KeyError, err)
+			}
+			c.health.observe(err)
+		}
+		c.health.probe.Unlock()
+	}
+	return c.health.snapshot(c.ZoneName)
+}
@@ -0,0 +1,90 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"time"
+
+	iaas "github.com/sacloud/iaas-api-go"
+	"github.com/sacloud/iaas-service-go/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/tracing"
+)
+
+// tracer creates the spans of SakuraCloud DNS API calls.
+var tracer = otel.Tracer("github.com/sacloud/external-dns-sacloud-webhook/internal/provider")
+
+// instrumentedService wraps a DNSService and records the count, latency and
+// errors of every call in the SakuraCloud API metrics, and a client span
+// per call.
+type instrumentedService struct {
+	next DNSService
+}
+
+// Instrument returns svc wrapped so that its calls are reported as metrics
+// and trace spans.
+func Instrument(svc DNSService) DNSService {
+	return &instrumentedService{next: svc}
+}
+
+// startCall starts the client span of one API operation.
+func startCall(ctx context.Context, operation string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("sakuracloud.operation", operation))
+	return tracer.Start(ctx, "SakuraCloud DNS "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
+
+func (s *instrumentedService) FindWithContext(ctx context.Context, req *dns.FindRequest) ([]*iaas.DNS, error) {
+	ctx, span := startCall(ctx, "find")
+	defer span.End()
+	start := time.Now()
+	zones, err := s.next.FindWithContext(ctx, req)
+	metrics.ObserveAPICall("find", start, err)
+	tracing.RecordError(span, err)
+	return zones, err
+}
+
+func (s *instrumentedService) ReadWithContext(ctx context.Context, req *dns.ReadRequest) (*iaas.DNS, error) {
+	ctx, span := startCall(ctx, "read", attribute.String("dns.zone_id", req.ID.String()))
+	defer span.End()
+	start := time.Now()
+	zone, err := s.next.ReadWithContext(ctx, req)
+	metrics.ObserveAPICall("read", start, err)
+	tracing.RecordError(span, err)
+	if err == nil && zone != nil {
+		span.SetAttributes(attribute.Int("dns.records", len(zone.Records)))
+	}
+	return zone, err
+}
+
+func (s *instrumentedService) UpdateWithContext(ctx context.Context, req *dns.UpdateRequest) (*iaas.DNS, error) {
+	ctx, span := startCall(ctx, "update",
+		attribute.String("dns.zone_id", req.ID.String()),
+		attribute.Int("dns.records", len(req.Records)),
+	)
+	defer span.End()
+	start := time.Now()
+	zone, err := s.next.UpdateWithContext(ctx, req)
+	metrics.ObserveAPICall("update", start, err)
+	tracing.RecordError(span, err)
+	return zone, err
+}
@@ -0,0 +1,52 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import "strings"
+
+// ApexName is the SakuraCloud record name of the zone apex.
+const ApexName = "@"
+
+// RelativeName maps the FQDN of a name in zone to its SakuraCloud record
+// name: the zone itself becomes "@", "*.example.com" becomes "*" and
+// "www.example.com." becomes "www". Names are lower-cased and lose their
+// trailing dot. A name outside zone, or already relative, is returned in
+// that normalized form.
+func RelativeName(fqdn, zone string) string {
+	name, zone := normalizeName(fqdn), normalizeName(zone)
+	switch {
+	case name == zone:
+		return ApexName
+	case strings.HasSuffix(name, "."+zone):
+		return strings.TrimSuffix(name, "."+zone)
+	}
+	return name
+}
+
+// FQDN maps a SakuraCloud record name in zone back to its FQDN, without a
+// trailing dot; "@" and the empty name map to the zone itself. Record names
+// are always relative, so a name that happens to end with the zone is still
+// qualified with it.
+func FQDN(name, zone string) string {
+	name, zone = normalizeName(name), normalizeName(zone)
+	if name == "" || name == ApexName {
+		return zone
+	}
+	return name + "." + zone
+}
+
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
@@ -0,0 +1,166 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrProtectedRecord is returned by ApplyChanges when a create or delete
+// touches a record matched by one of the client's ProtectRules.
+var ErrProtectedRecord = errors.New("record is protected")
+
+// ProtectRule matches records the webhook must never modify.
+type ProtectRule struct {
+	Type  string         // record type, or "" for any type
+	Glob  string         // shell pattern on the relative name or the FQDN
+	Regex *regexp.Regexp // alternative to Glob, written as /.../
+}
+
+// ParseProtectRule parses a rule of the form "[TYPE:]PATTERN". PATTERN is a
+// glob as understood by path.Match, or a regular expression between slashes,
+// and matches either the relative record name ("@" for the apex) or the
+// lower-cased FQDN without trailing dot. TYPE may be "*" for any type.
+//
+//	MX:@                        the MX records of the apex
+//	TXT:_acme-challenge*        ACME challenges at any name
+//	TXT:/^(_dmarc|_mta-sts)\./  by regular expression
+//	*._domainkey                DKIM keys of any type
+func ParseProtectRule(s string) (ProtectRule, error) {
+	var rule ProtectRule
+	pattern := strings.TrimSpace(s)
+	if typ, rest, ok := strings.Cut(pattern, ":"); ok && isRecordType(typ) {
+		if typ != "*" {
+			rule.Type = strings.ToUpper(typ)
+		}
+		pattern = rest
+	}
+	if pattern == "" {
+		return rule, fmt.Errorf("protect rule %q: empty name pattern", s)
+	}
+
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return rule, fmt.Errorf("protect rule %q: %w", s, err)
+		}
+		rule.Regex = re
+		return rule, nil
+	}
+	rule.Glob = strings.ToLower(pattern)
+	if _, err := path.Match(rule.Glob, ""); err != nil {
+		return rule, fmt.Errorf("protect rule %q: %w", s, err)
+	}
+	return rule, nil
+}
+
+// ParseProtectRules parses every rule of rules with ParseProtectRule.
+func ParseProtectRules(rules []string) ([]ProtectRule, error) {
+	parsed := make([]ProtectRule, 0, len(rules))
+	for _, s := range rules {
+		rule, err := ParseProtectRule(s)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+func isRecordType(s string) bool {
+	if s == "*" {
+		return true
+	}
+	for _, r := range s {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// String returns the rule in the form ParseProtectRule accepts.
+func (r ProtectRule) String() string {
+	typ := r.Type
+	if typ == "" {
+		typ = "*"
+	}
+	if r.Regex != nil {
+		return typ + ":/" + r.Regex.String() + "/"
+	}
+	return typ + ":" + r.Glob
+}
+
+// Matches reports whether the record of the given type and relative name
+// in zone is protected by r.
+func (r ProtectRule) Matches(recordType, name, zone string) bool {
+	if r.Type != "" && !strings.EqualFold(r.Type, recordType) {
+		return false
+	}
+	for _, n := range []string{RelativeName(name, zone), FQDN(name, zone)} {
+		if r.Regex != nil {
+			if r.Regex.MatchString(n) {
+				return true
+			}
+		} else if ok, _ := path.Match(r.Glob, n); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// protectedBy returns the first rule of c protecting rec, if any.
+func (c *Client) protectedBy(rec Record) (ProtectRule, bool) {
+	for _, rule := range c.ProtectRules {
+		if rule.Matches(rec.Type, rec.Name, c.ZoneName) {
+			return rule, true
+		}
+	}
+	return ProtectRule{}, false
+}
+
+// CheckProtected fails with ErrProtectedRecord when any record to create or
+// delete is protected, so that protected records are neither removed nor
+// overwritten, and no records are added next to them. It neither reads nor
+// writes the zone; ApplyChanges runs it as well.
+func (c *Client) CheckProtected(create, del []Record) error {
+	for _, recs := range [][]Record{del, create} {
+		for _, rec := range recs {
+			if rule, ok := c.protectedBy(rec); ok {
+				return fmt.Errorf("%w: %s %s matches rule %s",
+					ErrProtectedRecord, FQDN(rec.Name, c.ZoneName), rec.Type, rule)
+			}
+		}
+	}
+	return nil
+}
+
+// visible drops the records hidden by HideProtected from records.
+func (c *Client) visible(records []Record) []Record {
+	if !c.HideProtected || len(c.ProtectRules) == 0 {
+		return records
+	}
+	var out []Record
+	for _, rec := range records {
+		if _, ok := c.protectedBy(rec); !ok {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
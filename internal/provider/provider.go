@@ -16,15 +16,19 @@ package provider
 
 import (
 	"context"
-	"log"
+	"log/slog"
+	"time"
 
 	iaas "github.com/sacloud/iaas-api-go"
 	"github.com/sacloud/iaas-api-go/types"
 	"github.com/sacloud/iaas-service-go/dns"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
 )
 
 // Record represents a DNS record entry.
-// Type: record type (A, CNAME, TXT, etc.)
+// Type: record type (A, AAAA, CNAME, TXT, etc.)
 // Name: full record name under the zone
 // Targets: record values (IP addresses, CNAME targets, TXT strings)
 // TTL: record TTL in seconds
@@ -35,18 +39,37 @@ type Record struct {
 	TTL     int
 }
 
-// ListRecords fetches all DNS records for the configured zone.
+// ListRecords fetches all DNS records for the configured zone. Within
+// CacheTTL the records are served from memory.
+//
+// When the zone cannot be read and StaleWindow is set, the last records
+// read or written within that window are returned together with a
+// *StaleError wrapping the read error. Records matched by ProtectRules are
+// left out when HideProtected is set.
 func (c *Client) ListRecords(ctx context.Context) ([]Record, error) {
-	log.Printf("Listing records for zone '%s' (ID: %d)", c.ZoneName, c.ZoneID)
-	dnsZone, err := c.Service.ReadWithContext(ctx, &dns.ReadRequest{ID: c.ZoneID})
+	logger := logging.FromContext(ctx).With(logging.KeyZone, c.ZoneName)
+	zoneRecords, err := c.readRecords(ctx, logger)
 	if err != nil {
-		log.Printf("Error reading DNS zone: %v", err)
-		return nil, err
+		if c.StaleWindow <= 0 {
+			return nil, err
+		}
+		snapshot, age, ok := c.cache.stale(c.StaleWindow)
+		if !ok {
+			return nil, err
+		}
+		logger.Warn("serving stale records", "age", age, logging.KeyError, err)
+		metrics.StaleServes.WithLabelValues(c.ZoneName).Inc()
+		return c.visible(toRecords(logger, snapshot)), &StaleError{Zone: c.ZoneName, Age: age, Err: err}
 	}
+	return c.visible(toRecords(logger, zoneRecords)), nil
+}
+
+// toRecords converts SakuraCloud records to Records with canonical targets.
+func toRecords(logger *slog.Logger, zoneRecords []*iaas.DNSRecord) []Record {
 
 	var records []Record
-	for _, rs := range dnsZone.Records {
-		rdata := rs.RData
+	for _, rs := range zoneRecords {
+		rdata := canonicalRData(string(rs.Type), rs.RData)
 		if len(rdata) > 0 && rdata[len(rdata)-1] == '.' {
 			rdata = rdata[:len(rdata)-1]
 		}
@@ -56,33 +79,217 @@ func (c *Client) ListRecords(ctx context.Context) ([]Record, error) {
 			Targets: []string{rdata},
 			TTL:     rs.TTL,
 		}
-		log.Printf("Found record: %s %s -> %v (TTL=%d)", rec.Type, rec.Name, rec.Targets, rec.TTL)
+		logger.Debug("found record", logging.KeyRecordName, rec.Name, logging.KeyRecordType, rec.Type,
+			"targets", rec.Targets, "ttl", rec.TTL)
 		records = append(records, rec)
 	}
-	return records, nil
+	return records
+}
+
+// readRecords returns the zone records from the cache or, on a miss,
+// from the API.
+func (c *Client) readRecords(ctx context.Context, logger *slog.Logger) ([]*iaas.DNSRecord, error) {
+	gen := c.cache.generation()
+	if c.CacheTTL > 0 {
+		cached, g, ok := c.cache.get(c.ZoneName, c.CacheTTL)
+		if ok {
+			logger.Debug("listing records from cache", "records", len(cached))
+			return cached, nil
+		}
+		gen = g
+	}
+
+	logger.Debug("listing records", "zone_id", c.ZoneID)
+	dnsZone, err := c.Service.ReadWithContext(ctx, &dns.ReadRequest{ID: c.ZoneID})
+	c.health.observe(err)
+	if err != nil {
+		logger.Error("failed to read DNS zone", logging.KeyError, err)
+		return nil, err
+	}
+	metrics.ObserveSync(c.ZoneName, len(dnsZone.Records))
+	if c.CacheTTL > 0 || c.StaleWindow > 0 {
+		c.cache.storeIfCurrent(gen, dnsZone.Records)
+	}
+	return dnsZone.Records, nil
 }
 
 // ApplyChanges applies create and delete operations to DNS records.
+// Every target of a Record maps to its own SakuraCloud record, so a
+// multi-target create adds one record per target and a multi-target delete
+// removes all of them.
+//
+// The zone is updated with a read-modify-write guarded by its SettingsHash.
+// When the update is rejected because the zone changed in between, the zone
+// is read again and the same intent is re-applied, with bounded exponential
+// backoff. ErrIntentConflict is returned when the concurrent change makes
+// the intent itself impossible to apply. A *ValidationError is returned,
+// without writing anything, when a created CNAME would share its name with
+// another record, and ErrDeletionLimit when the update would delete more
+// records than the deletion limits allow. A change touching a record
+// matched by ProtectRules fails with ErrProtectedRecord before the zone is
+// read.
+//
+// Concurrent calls for the same zone are queued and applied one at a time
+// in arrival order; their wait is exposed as metrics.ApplyQueueWait.
+//
+// In DryRun mode the new record set is computed and its diff is logged and
+// exposed through LastDiff, but the zone is never updated.
 func (c *Client) ApplyChanges(ctx context.Context, create, del []Record) error {
-	log.Printf("Applying changes: create %d, delete %d records", len(create), len(del))
+	logger := logging.FromContext(ctx).With(logging.KeyZone, c.ZoneName)
+	logger.Debug("applying changes", "create", len(create), "delete", len(del))
 	if len(create) == 0 && len(del) == 0 {
-        log.Printf("No-op: nothing to create/delete, skip DNS update")
-        return nil
-    }
+		logger.Debug("nothing to create or delete, skipping DNS update")
+		return nil
+	}
+	if err := c.CheckProtected(create, del); err != nil {
+		logger.Warn("refusing change to protected record", logging.KeyError, err)
+		return err
+	}
+
+	// Serialize change batches per zone so each one reads the state left by
+	// the previous one instead of overwriting it.
+	wait, err := c.queue.acquire(ctx, c.ZoneName)
+	if err != nil {
+		logger.Warn("gave up waiting for apply queue", "wait", wait, logging.KeyError, err)
+		return err
+	}
+	defer c.queue.release()
+	logger.Debug("acquired apply queue", "wait", wait)
+
+	retries, backoff := c.conflictPolicy()
+	for attempt := 0; ; attempt++ {
+		err := c.applyOnce(ctx, logger, create, del, attempt > 0)
+		if err == nil {
+			if c.DryRun {
+				metrics.Applies.WithLabelValues(c.ZoneName, "dry_run").Inc()
+				logger.Info("dry-run: skipped DNS update")
+				return nil
+			}
+			metrics.Applies.WithLabelValues(c.ZoneName, "success").Inc()
+			logger.Info("DNS changes applied")
+			return nil
+		}
+		if !isConflictError(err) || attempt >= retries {
+			metrics.Applies.WithLabelValues(c.ZoneName, "error").Inc()
+			logger.Error("failed to apply DNS changes", logging.KeyError, err)
+			return err
+		}
+
+		wait := backoff << attempt
+		logger.Warn("zone was modified concurrently, retrying",
+			"attempt", attempt+1, "max_attempts", retries+1, "backoff", wait, logging.KeyError, err)
+		select {
+		case <-ctx.Done():
+			metrics.Applies.WithLabelValues(c.ZoneName, "error").Inc()
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
 
+// CheckChanges reads the zone and reports, without writing anything, a
+// *ValidationError when applying create and del to its current records
+// would leave a CNAME sharing its name with another record, and
+// ErrDeletionLimit when it would delete more records than the deletion
+// limits allow. ApplyChanges repeats both checks, as the zone may change in
+// between.
+func (c *Client) CheckChanges(ctx context.Context, create, del []Record) error {
+	if len(create) == 0 && len(del) == 0 {
+		return nil
+	}
+	logger := logging.FromContext(ctx).With(logging.KeyZone, c.ZoneName)
 	dnsZone, err := c.Service.ReadWithContext(ctx, &dns.ReadRequest{ID: c.ZoneID})
+	c.health.observe(err)
 	if err != nil {
-		log.Printf("Error reading DNS zone before update: %v", err)
+		logger.Error("failed to read DNS zone before update", logging.KeyError, err)
 		return err
 	}
 
+	newSets := applyIntent(dnsZone.Records, create, del)
+	if problems := validateZone(c.ZoneName, newSets, create); len(problems) > 0 {
+		return &ValidationError{Zone: c.ZoneName, Problems: problems}
+	}
+	return c.checkDeletions(logger, diffRecords(dnsZone.Records, newSets))
+}
+
+// applyOnce reads the zone, applies the intent to its current records and
+// writes the result back. On retries the intent is verified against the
+// fresh records first.
+func (c *Client) applyOnce(ctx context.Context, logger *slog.Logger, create, del []Record, retry bool) error {
+	dnsZone, err := c.Service.ReadWithContext(ctx, &dns.ReadRequest{ID: c.ZoneID})
+	c.health.observe(err)
+	if err != nil {
+		logger.Error("failed to read DNS zone before update", logging.KeyError, err)
+		return err
+	}
+
+	if retry {
+		if err := checkIntent(dnsZone.Records, create, del); err != nil {
+			return err
+		}
+	}
+
+	newSets := applyIntent(dnsZone.Records, create, del)
+	if problems := validateZone(c.ZoneName, newSets, create); len(problems) > 0 {
+		return &ValidationError{Zone: c.ZoneName, Problems: problems}
+	}
+
+	diff := diffRecords(dnsZone.Records, newSets)
+	diff.Zone = c.ZoneName
+	diff.DryRun = c.DryRun
+	diff.Time = time.Now()
+	c.lastDiff.set(diff)
+	logDiff(logger, diff)
+	if err := c.checkDeletions(logger, diff); err != nil {
+		return err
+	}
+	if c.DryRun {
+		return nil
+	}
+
+	updateReq := &dns.UpdateRequest{
+		ID:           c.ZoneID,
+		Records:      newSets,
+		SettingsHash: dnsZone.SettingsHash, // Preserve existing settings hash
+	}
+
+	// Abort cleanly if ctx is done before the zone is written, but never
+	// cancel an update half-way: each attempt is bounded by the API client
+	// timeout, and no retry starts past the deadline of ctx.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	updated, err := c.Service.UpdateWithContext(detach(ctx), updateReq)
+	c.health.observe(err)
+	if err != nil {
+		// The zone may or may not have changed; read it again next time
+		c.cache.invalidate()
+		return err
+	}
+	if updated != nil && updated.Records != nil {
+		c.cache.store(updated.Records)
+	} else {
+		c.cache.store(newSets)
+	}
+	metrics.RecordsCreated.WithLabelValues(c.ZoneName).Add(float64(len(diff.Added)))
+	metrics.RecordsDeleted.WithLabelValues(c.ZoneName).Add(float64(len(diff.Removed)))
+	metrics.ObserveSync(c.ZoneName, len(newSets))
+	return nil
+}
+
+// applyIntent returns the record set that results from applying the
+// create and delete intent to the current zone records.
+//
+// A zone record is deleted when it matches any target of a Record in del.
+// Each target of a Record in create becomes a separate record; targets that
+// already exist in the resulting set are skipped to keep the update idempotent.
+func applyIntent(current []*iaas.DNSRecord, create, del []Record) []*iaas.DNSRecord {
 	var newSets []*iaas.DNSRecord
-	for _, rs := range dnsZone.Records {
+	for _, rs := range current {
 		shouldDelete := false
 		for _, dRec := range del {
-			// Compare Type, Name, and RData (Targets[0]) for precise deletion
-			if string(rs.Type) == dRec.Type && rs.Name == dRec.Name && rs.RData == dRec.Targets[0] {
-				log.Printf("Deleting record: %s %s -> %v", dRec.Type, dRec.Name, dRec.Targets)
+			// Compare Type, Name, and RData for precise deletion
+			if recordMatches(rs, dRec) {
 				shouldDelete = true
 				break
 			}
@@ -97,26 +304,23 @@ func (c *Client) ApplyChanges(ctx context.Context, create, del []Record) error {
 		if ttl == 0 {
 			ttl = 3600 // fallback default
 		}
-		newRec := &iaas.DNSRecord{
-			Type:  types.EDNSRecordType(cRec.Type),
-			Name:  cRec.Name,
-			RData: cRec.Targets[0],
-			TTL:   ttl,
+		for _, target := range cRec.Targets {
+			newRec := &iaas.DNSRecord{
+				Type:  types.EDNSRecordType(cRec.Type),
+				Name:  cRec.Name,
+				RData: target,
+				TTL:   ttl,
+			}
+			if containsRecord(newSets, newRec) {
+				continue
+			}
+			newSets = append(newSets, newRec)
 		}
-		log.Printf("Creating record: %s %s -> %v (TTL=%d)", newRec.Type, newRec.Name, newRec.RData, newRec.TTL)
-		newSets = append(newSets, newRec)
-	}
-
-	updateReq := &dns.UpdateRequest{
-		ID:      c.ZoneID,
-		Records: newSets,
-		SettingsHash: dnsZone.SettingsHash, // Preserve existing settings hash
 	}
+	return newSets
+}
 
-	if _, err := c.Service.UpdateWithContext(ctx, updateReq); err != nil {
-		log.Printf("Error applying DNS changes: %v", err)
-		return err
-	}
-	log.Printf("DNS changes applied successfully")
-	return nil
+// containsRecord reports whether sets already holds a record equivalent to rec.
+func containsRecord(sets []*iaas.DNSRecord, rec *iaas.DNSRecord) bool {
+	return anyMatches(sets, Record{Type: string(rec.Type), Name: rec.Name, Targets: []string{rec.RData}})
 }
@@ -17,12 +17,27 @@ package provider
 import (
 	"context"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
 	iaas "github.com/sacloud/iaas-api-go"
 	"github.com/sacloud/iaas-api-go/types"
 	"github.com/sacloud/iaas-service-go/dns"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
 )
 
 type fakeDNSService struct {
@@ -33,6 +48,12 @@ type fakeDNSService struct {
 	updateResp    *iaas.DNS
 	updateErr     error
 	lastUpdateReq *dns.UpdateRequest
+
+	// Optional per-call sequences; once exhausted the fields above are used
+	readSeq      []*iaas.DNS
+	updateErrSeq []error
+	readCalls    int
+	updateCalls  int
 }
 
 func (f *fakeDNSService) FindWithContext(ctx context.Context, req *dns.FindRequest) ([]*iaas.DNS, error) {
@@ -46,6 +67,12 @@ func (f *fakeDNSService) ReadWithContext(ctx context.Context, req *dns.ReadReque
 	if ctx != nil && ctx.Err() != nil {
 		return nil, ctx.Err()
 	}
+	f.readCalls++
+	if len(f.readSeq) > 0 {
+		resp := f.readSeq[0]
+		f.readSeq = f.readSeq[1:]
+		return resp, nil
+	}
 	return f.readResp, f.readErr
 }
 
@@ -54,6 +81,12 @@ func (f *fakeDNSService) UpdateWithContext(ctx context.Context, req *dns.UpdateR
 		return nil, ctx.Err()
 	}
 	f.lastUpdateReq = req
+	f.updateCalls++
+	if len(f.updateErrSeq) > 0 {
+		err := f.updateErrSeq[0]
+		f.updateErrSeq = f.updateErrSeq[1:]
+		return f.updateResp, err
+	}
 	return f.updateResp, f.updateErr
 }
 
@@ -224,3 +257,1299 @@ func TestApplyChanges_Error(t *testing.T) {
 		t.Fatal("expected UpdateWithContext to be called, but it wasn't")
 	}
 }
+
+func TestApplyChanges_AAAA_CanonicalDeletion(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   1,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "v6", Type: types.EDNSRecordType("AAAA"), RData: "2001:0db8:0000:0000:0000:0000:0000:0001"},
+				{Name: "keep", Type: types.EDNSRecordType("AAAA"), RData: "2001:db8::2"},
+			},
+		},
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	err := client.ApplyChanges(context.Background(),
+		nil,
+		[]Record{{Name: "v6", Type: "AAAA", Targets: []string{"2001:db8::1"}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if got := fake.lastUpdateReq.Records; len(got) != 1 || got[0].Name != "keep" {
+		t.Errorf("UpdateRequest.Records = %#v; want only \"keep\"", got)
+	}
+
+	records, err := client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if records[0].Targets[0] != "2001:db8::1" {
+		t.Errorf("ListRecords() AAAA target = %q; want canonical \"2001:db8::1\"", records[0].Targets[0])
+	}
+
+	// IPv4-mapped addresses are reported as AAAA values, not as IPv4
+	fake.readResp.Records = []*iaas.DNSRecord{{Name: "mapped", Type: types.EDNSRecordType("AAAA"), RData: "::ffff:1.2.3.4"}}
+	records, err = client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if records[0].Targets[0] != "::ffff:1.2.3.4" {
+		t.Errorf("ListRecords() mapped AAAA target = %q; want \"::ffff:1.2.3.4\"", records[0].Targets[0])
+	}
+}
+
+func TestMXRoundTrip(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   1,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "@", Type: types.EDNSRecordType("MX"), RData: "10 mail.example.com."},
+				{Name: "@", Type: types.EDNSRecordType("MX"), RData: "20 backup.example.com."},
+			},
+		},
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	records, err := client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if got := records[0].Targets[0]; got != "10 mail.example.com" {
+		t.Errorf("ListRecords() MX target = %q; want \"10 mail.example.com\"", got)
+	}
+
+	err = client.ApplyChanges(context.Background(),
+		[]Record{{Name: "@", Type: "MX", Targets: []string{"30 mail.example.com."}}},
+		[]Record{{Name: "@", Type: "MX", Targets: []string{"10 MAIL.example.com."}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	got := fake.lastUpdateReq.Records
+	if len(got) != 2 || got[0].RData != "20 backup.example.com." || got[1].RData != "30 mail.example.com." {
+		t.Errorf("UpdateRequest.Records = %#v; want backup kept and mail re-prioritized", got)
+	}
+}
+
+func TestMXKeepsHostCase(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   1,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "@", Type: types.EDNSRecordType("MX"), RData: "10 MX.Example.com."},
+			},
+		},
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	// GET /records must report the value external-dns asked for, or every
+	// sync plans an update
+	records, err := client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if got := records[0].Targets[0]; got != "10 MX.Example.com" {
+		t.Errorf("ListRecords() MX target = %q; want \"10 MX.Example.com\"", got)
+	}
+
+	// Deletion still matches regardless of case
+	err = client.ApplyChanges(context.Background(), nil,
+		[]Record{{Name: "@", Type: "MX", Targets: []string{"10 mx.example.com."}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if got := fake.lastUpdateReq.Records; len(got) != 0 {
+		t.Errorf("UpdateRequest.Records = %#v; want the MX record deleted", got)
+	}
+}
+
+func TestParseMX(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"10 mail.example.com", "10 mail.example.com.", false},
+		{"0 .", "0 .", false},
+		{"65535 mx.example.com.", "65535 mx.example.com.", false},
+		{"10 MX.Example.com", "10 MX.Example.com.", false},
+		{"65536 mx.example.com.", "", true},
+		{"-1 mx.example.com.", "", true},
+		{"mx.example.com.", "", true},
+		{"10 a b", "", true},
+	}
+	for _, tc := range cases {
+		mx, err := ParseMX(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseMX(%q) error = %v; wantErr %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if err == nil && mx.String() != tc.want {
+			t.Errorf("ParseMX(%q) = %q; want %q", tc.in, mx.String(), tc.want)
+		}
+	}
+}
+
+func TestApplyChanges_SRV_FieldAwareDeletion(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   1,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "_sip._tcp", Type: types.EDNSRecordType("SRV"), RData: "10  5 5060 sip.example.com."},
+				{Name: "_minecraft._tcp", Type: types.EDNSRecordType("SRV"), RData: "0 0 25565 mc.example.com."},
+			},
+		},
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	err := client.ApplyChanges(context.Background(),
+		nil,
+		[]Record{{Name: "_sip._tcp", Type: "SRV", Targets: []string{"10 5 5060 SIP.example.com."}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if got := fake.lastUpdateReq.Records; len(got) != 1 || got[0].Name != "_minecraft._tcp" {
+		t.Errorf("UpdateRequest.Records = %#v; want only \"_minecraft._tcp\"", got)
+	}
+}
+
+func TestParseSRV(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{"10 5 5060 sip.example.com", "10 5 5060 sip.example.com.", false},
+		{" 0\t0 25565  MC.example.com. ", "0 0 25565 MC.example.com.", false},
+		{"10 5 70000 sip.example.com.", "", true},
+		{"10 x 5060 sip.example.com.", "", true},
+		{"10 5 sip.example.com.", "", true},
+	}
+	for _, tc := range cases {
+		srv, err := ParseSRV(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseSRV(%q) error = %v; wantErr %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if err == nil && srv.String() != tc.want {
+			t.Errorf("ParseSRV(%q) = %q; want %q", tc.in, srv.String(), tc.want)
+		}
+	}
+}
+
+func TestParseCAA(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{`0 issue "letsencrypt.org"`, `0 issue "letsencrypt.org"`, false},
+		{`0 ISSUEWILD letsencrypt.org`, `0 issuewild "letsencrypt.org"`, false},
+		{`128 iodef "mailto:security@example.com"`, `128 iodef "mailto:security@example.com"`, false},
+		{`0 issue "ca.example.net; account=230123"`, `0 issue "ca.example.net; account=230123"`, false},
+		{`256 issue "letsencrypt.org"`, "", true},
+		{`0 tbs "letsencrypt.org"`, "", true},
+		{`0 issue`, "", true},
+		{`0 issue "letsencrypt.org`, "", true},
+	}
+	for _, tc := range cases {
+		caa, err := ParseCAA(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("ParseCAA(%q) error = %v; wantErr %v", tc.in, err, tc.wantErr)
+			continue
+		}
+		if err == nil && caa.String() != tc.want {
+			t.Errorf("ParseCAA(%q) = %q; want %q", tc.in, caa.String(), tc.want)
+		}
+	}
+}
+
+func TestCAARoundTrip(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   1,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "@", Type: types.EDNSRecordType("CAA"), RData: `0 issue "letsencrypt.org"`},
+			},
+		},
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	records, err := client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if got := records[0].Targets[0]; got != `0 issue "letsencrypt.org"` {
+		t.Errorf("ListRecords() CAA target = %q", got)
+	}
+
+	err = client.ApplyChanges(context.Background(),
+		nil,
+		[]Record{{Name: "@", Type: "CAA", Targets: []string{`0  issue  letsencrypt.org`}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if got := fake.lastUpdateReq.Records; len(got) != 0 {
+		t.Errorf("UpdateRequest.Records = %#v; want CAA record deleted", got)
+	}
+}
+
+func TestApplyChanges_MultiTarget(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   1,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "old", Type: types.EDNSRecordType("A"), RData: "1.1.1.1"},
+				{Name: "old", Type: types.EDNSRecordType("A"), RData: "1.1.1.2"},
+				{Name: "keep", Type: types.EDNSRecordType("A"), RData: "1.1.1.3"},
+			},
+		},
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	err := client.ApplyChanges(context.Background(),
+		[]Record{{Name: "lb", Type: "A", Targets: []string{"2.2.2.1", "2.2.2.2", "2.2.2.1"}, TTL: 60}},
+		[]Record{{Name: "old", Type: "A", Targets: []string{"1.1.1.1", "1.1.1.2"}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, rec := range fake.lastUpdateReq.Records {
+		got = append(got, rec.Name+"="+rec.RData)
+	}
+	want := []string{"keep=1.1.1.3", "lb=2.2.2.1", "lb=2.2.2.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UpdateRequest.Records = %v; want %v", got, want)
+	}
+}
+
+func conflictErr() error {
+	return iaas.NewAPIError(http.MethodPut, nil, http.StatusConflict, &iaas.APIErrorResponse{
+		ErrorCode:    "conflict",
+		ErrorMessage: "settings hash mismatch",
+	})
+}
+
+func TestApplyChanges_RetriesOnConflict(t *testing.T) {
+	fake := &fakeDNSService{
+		readSeq: []*iaas.DNS{
+			{ID: 1, SettingsHash: "v1", Records: []*iaas.DNSRecord{
+				{Name: "old", Type: types.EDNSRecordType("A"), RData: "1.1.1.1"},
+			}},
+			// A colleague added "manual" in the meantime
+			{ID: 1, SettingsHash: "v2", Records: []*iaas.DNSRecord{
+				{Name: "old", Type: types.EDNSRecordType("A"), RData: "1.1.1.1"},
+				{Name: "manual", Type: types.EDNSRecordType("A"), RData: "9.9.9.9"},
+			}},
+		},
+		updateErrSeq: []error{conflictErr()},
+		updateResp:   &iaas.DNS{},
+	}
+	client := &Client{
+		Context:         context.Background(),
+		Service:         fake,
+		ZoneName:        "example.com",
+		ZoneID:          1,
+		ConflictBackoff: time.Millisecond,
+	}
+
+	err := client.ApplyChanges(context.Background(),
+		[]Record{{Name: "new", Type: "A", Targets: []string{"2.2.2.2"}}},
+		[]Record{{Name: "old", Type: "A", Targets: []string{"1.1.1.1"}}},
+	)
+	if err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if fake.updateCalls != 2 {
+		t.Errorf("UpdateWithContext called %d times; want 2", fake.updateCalls)
+	}
+	req := fake.lastUpdateReq
+	if req.SettingsHash != "v2" {
+		t.Errorf("retry used SettingsHash %q; want \"v2\"", req.SettingsHash)
+	}
+	var got []string
+	for _, rec := range req.Records {
+		got = append(got, rec.Name+"="+rec.RData)
+	}
+	want := []string{"manual=9.9.9.9", "new=2.2.2.2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("UpdateRequest.Records = %v; want %v", got, want)
+	}
+}
+
+func TestApplyChanges_ConflictRetriesExhausted(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp:   &iaas.DNS{ID: 1},
+		updateErr:  conflictErr(),
+		updateResp: &iaas.DNS{},
+	}
+	client := &Client{
+		Context:         context.Background(),
+		Service:         fake,
+		ZoneName:        "example.com",
+		ZoneID:          1,
+		ConflictRetries: 2,
+		ConflictBackoff: time.Millisecond,
+	}
+
+	err := client.ApplyChanges(context.Background(),
+		[]Record{{Name: "new", Type: "A", Targets: []string{"2.2.2.2"}}}, nil)
+	if !isConflictError(err) {
+		t.Fatalf("ApplyChanges() error = %v; want conflict error", err)
+	}
+	if fake.updateCalls != 3 {
+		t.Errorf("UpdateWithContext called %d times; want 3", fake.updateCalls)
+	}
+}
+
+func TestApplyChanges_IntentConflict(t *testing.T) {
+	fake := &fakeDNSService{
+		readSeq: []*iaas.DNS{
+			{ID: 1, Records: []*iaas.DNSRecord{
+				{Name: "www", Type: types.EDNSRecordType("CNAME"), RData: "a.example.net."},
+			}},
+			// Someone repointed the CNAME we are about to replace
+			{ID: 1, Records: []*iaas.DNSRecord{
+				{Name: "www", Type: types.EDNSRecordType("CNAME"), RData: "c.example.net."},
+			}},
+		},
+		updateErrSeq: []error{conflictErr()},
+		updateResp:   &iaas.DNS{},
+	}
+	client := &Client{
+		Context:         context.Background(),
+		Service:         fake,
+		ZoneName:        "example.com",
+		ZoneID:          1,
+		ConflictBackoff: time.Millisecond,
+	}
+
+	err := client.ApplyChanges(context.Background(),
+		[]Record{{Name: "www", Type: "CNAME", Targets: []string{"b.example.net."}}},
+		[]Record{{Name: "www", Type: "CNAME", Targets: []string{"a.example.net."}}},
+	)
+	if !errors.Is(err, ErrIntentConflict) {
+		t.Fatalf("ApplyChanges() error = %v; want ErrIntentConflict", err)
+	}
+	if fake.updateCalls != 1 {
+		t.Errorf("UpdateWithContext called %d times; want 1", fake.updateCalls)
+	}
+}
+
+// memDNSService is a concurrency-safe in-memory zone that records how many
+// updates ran at the same time.
+type memDNSService struct {
+	mu          sync.Mutex
+	records     []*iaas.DNSRecord
+	inFlight    int
+	maxInFlight int
+}
+
+func (m *memDNSService) FindWithContext(ctx context.Context, req *dns.FindRequest) ([]*iaas.DNS, error) {
+	return nil, nil
+}
+
+func (m *memDNSService) ReadWithContext(ctx context.Context, req *dns.ReadRequest) (*iaas.DNS, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return &iaas.DNS{ID: req.ID, Records: append([]*iaas.DNSRecord(nil), m.records...)}, nil
+}
+
+func (m *memDNSService) UpdateWithContext(ctx context.Context, req *dns.UpdateRequest) (*iaas.DNS, error) {
+	m.mu.Lock()
+	m.inFlight++
+	if m.inFlight > m.maxInFlight {
+		m.maxInFlight = m.inFlight
+	}
+	m.mu.Unlock()
+
+	time.Sleep(2 * time.Millisecond)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight--
+	m.records = req.Records
+	return &iaas.DNS{}, nil
+}
+
+func TestApplyChanges_SerializedPerZone(t *testing.T) {
+	svc := &memDNSService{}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  svc,
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+
+	const n = 10
+	waitsBefore := sampleCount(t, metrics.ApplyQueueWait.WithLabelValues("example.com"))
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := Record{Name: fmt.Sprintf("host%d", i), Type: "A", Targets: []string{fmt.Sprintf("10.0.0.%d", i)}}
+			if err := client.ApplyChanges(context.Background(), []Record{rec}, nil); err != nil {
+				t.Errorf("ApplyChanges() unexpected error: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(svc.records) != n {
+		t.Errorf("zone has %d records; want %d (concurrent batches overwrote each other)", len(svc.records), n)
+	}
+	if svc.maxInFlight != 1 {
+		t.Errorf("max concurrent updates = %d; want 1", svc.maxInFlight)
+	}
+	if got := sampleCount(t, metrics.ApplyQueueWait.WithLabelValues("example.com")) - waitsBefore; got != n {
+		t.Errorf("apply queue waits observed = %d; want %d", got, n)
+	}
+}
+
+// sampleCount returns the number of observations made by a histogram.
+func sampleCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Metric).Write(&m); err != nil {
+		t.Fatalf("failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestApplyChanges_QueueWaitHonorsContext(t *testing.T) {
+	client := &Client{
+		Context:  context.Background(),
+		Service:  &memDNSService{},
+		ZoneName: "example.com",
+		ZoneID:   1,
+	}
+	// Hold the queue as if another batch were being applied
+	if _, err := client.queue.acquire(context.Background(), "example.com"); err != nil {
+		t.Fatalf("acquire() unexpected error: %v", err)
+	}
+	defer client.queue.release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	err := client.ApplyChanges(ctx, []Record{{Name: "x", Type: "A", Targets: []string{"1.1.1.1"}}}, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ApplyChanges() error = %v; want context.DeadlineExceeded", err)
+	}
+}
+
+func TestApplyChanges_DryRun(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   42,
+			Name: "example.com",
+			Records: []*iaas.DNSRecord{
+				{Name: "keep", Type: types.EDNSRecordType("A"), RData: "1.1.1.1", TTL: 300},
+				{Name: "old", Type: types.EDNSRecordType("A"), RData: "2.2.2.2", TTL: 300},
+			},
+		},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "example.com",
+		ZoneID:   42,
+		DryRun:   true,
+	}
+
+	create := []Record{{Type: "A", Name: "new", Targets: []string{"3.3.3.3"}, TTL: 600}}
+	del := []Record{{Type: "A", Name: "old", Targets: []string{"2.2.2.2"}}}
+	if err := client.ApplyChanges(context.Background(), create, del); err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if fake.updateCalls != 0 {
+		t.Errorf("UpdateWithContext called %d times in dry-run; want 0", fake.updateCalls)
+	}
+
+	diff := client.LastDiff()
+	if diff == nil {
+		t.Fatal("LastDiff() = nil; want a diff")
+	}
+	if !diff.DryRun || diff.Zone != "example.com" {
+		t.Errorf("diff zone/dryRun = %q/%v; want example.com/true", diff.Zone, diff.DryRun)
+	}
+	name := func(rs []*iaas.DNSRecord) []string {
+		var out []string
+		for _, r := range rs {
+			out = append(out, r.Name)
+		}
+		return out
+	}
+	if got := name(diff.Added); !reflect.DeepEqual(got, []string{"new"}) {
+		t.Errorf("Added = %v; want [new]", got)
+	}
+	if got := name(diff.Removed); !reflect.DeepEqual(got, []string{"old"}) {
+		t.Errorf("Removed = %v; want [old]", got)
+	}
+	if got := name(diff.Unchanged); !reflect.DeepEqual(got, []string{"keep"}) {
+		t.Errorf("Unchanged = %v; want [keep]", got)
+	}
+
+	// ListRecords still reflects the live zone
+	records, err := client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if len(records) != 2 {
+		t.Errorf("ListRecords() returned %d records; want 2", len(records))
+	}
+}
+
+func TestApplyChanges_Metrics(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   7,
+			Name: "metrics.example",
+			Records: []*iaas.DNSRecord{
+				{Name: "old", Type: types.EDNSRecordType("A"), RData: "2.2.2.2", TTL: 300},
+			},
+		},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  Instrument(fake),
+		ZoneName: "metrics.example",
+		ZoneID:   7,
+	}
+
+	readsBefore := testutil.ToFloat64(metrics.APICalls.WithLabelValues("read"))
+	create := []Record{{Type: "A", Name: "new", Targets: []string{"3.3.3.3", "4.4.4.4"}}}
+	del := []Record{{Type: "A", Name: "old", Targets: []string{"2.2.2.2"}}}
+	if err := client.ApplyChanges(context.Background(), create, del); err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+
+	if got := testutil.ToFloat64(metrics.APICalls.WithLabelValues("read")) - readsBefore; got != 1 {
+		t.Errorf("read calls increased by %v; want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.RecordsCreated.WithLabelValues("metrics.example")); got != 2 {
+		t.Errorf("records created = %v; want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.RecordsDeleted.WithLabelValues("metrics.example")); got != 1 {
+		t.Errorf("records deleted = %v; want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.ZoneRecords.WithLabelValues("metrics.example")); got != 2 {
+		t.Errorf("zone records = %v; want 2", got)
+	}
+	if got := testutil.ToFloat64(metrics.Applies.WithLabelValues("metrics.example", "success")); got != 1 {
+		t.Errorf("successful applies = %v; want 1", got)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	fake := &fakeDNSService{readResp: &iaas.DNS{ID: 1, Name: "example.com"}}
+	client := &Client{
+		Context:      context.Background(),
+		Service:      fake,
+		ZoneName:     "example.com",
+		ZoneID:       1,
+		HealthMaxAge: time.Hour,
+	}
+
+	// Nothing observed yet: Health probes the zone once
+	if zh := client.Health(context.Background()); !zh.Ready || zh.LastSuccess == nil {
+		t.Fatalf("Health() = %+v; want ready with lastSuccess", zh)
+	}
+	if fake.readCalls != 1 {
+		t.Fatalf("readCalls = %d; want 1 probe", fake.readCalls)
+	}
+
+	// A cached outcome is reused without reaching the API
+	client.Health(context.Background())
+	if fake.readCalls != 1 {
+		t.Errorf("readCalls = %d; want cached outcome", fake.readCalls)
+	}
+
+	// A failed ListRecords makes the zone unready without another probe
+	fake.readErr = errors.New("401 unauthorized")
+	fake.readResp = nil
+	if _, err := client.ListRecords(context.Background()); err == nil {
+		t.Fatal("ListRecords() expected error")
+	}
+	zh := client.Health(context.Background())
+	if zh.Ready || zh.LastError != "401 unauthorized" || zh.LastErrorTime == nil {
+		t.Errorf("Health() = %+v; want unready with last error", zh)
+	}
+	if fake.readCalls != 2 {
+		t.Errorf("readCalls = %d; want 2", fake.readCalls)
+	}
+}
+
+func TestHealth_ConflictCountsAsReachable(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp:  &iaas.DNS{ID: 1, Name: "example.com"},
+		updateErr: conflictErr(),
+	}
+	client := &Client{
+		Context:         context.Background(),
+		Service:         fake,
+		ZoneName:        "example.com",
+		ZoneID:          1,
+		ConflictRetries: 1,
+		ConflictBackoff: time.Millisecond,
+		HealthMaxAge:    time.Hour,
+	}
+
+	create := []Record{{Type: "A", Name: "www", Targets: []string{"1.2.3.4"}}}
+	if err := client.ApplyChanges(context.Background(), create, nil); err == nil {
+		t.Fatal("ApplyChanges() expected conflict error")
+	}
+	if zh := client.Health(context.Background()); !zh.Ready {
+		t.Errorf("Health() = %+v; want ready after conflict", zh)
+	}
+}
+
+func TestInstrument_Spans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	fake := &fakeDNSService{readErr: errors.New("503 service unavailable")}
+	client := &Client{Context: context.Background(), Service: Instrument(fake), ZoneName: "example.com", ZoneID: 5}
+	if _, err := client.ListRecords(context.Background()); err == nil {
+		t.Fatal("ListRecords() expected error")
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "SakuraCloud DNS read" {
+		t.Fatalf("spans = %v; want one SakuraCloud DNS read span", spans)
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("span status = %v; want Error", spans[0].Status().Code)
+	}
+}
+
+func TestListRecords_Cache(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   9,
+			Name: "cache.example",
+			Records: []*iaas.DNSRecord{
+				{Name: "www", Type: types.EDNSRecordType("A"), RData: "1.1.1.1", TTL: 300},
+			},
+		},
+	}
+	client := &Client{
+		Context:  context.Background(),
+		Service:  fake,
+		ZoneName: "cache.example",
+		ZoneID:   9,
+		CacheTTL: time.Hour,
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.ListRecords(context.Background()); err != nil {
+			t.Fatalf("ListRecords() unexpected error: %v", err)
+		}
+	}
+	if fake.readCalls != 1 {
+		t.Errorf("readCalls = %d; want 1", fake.readCalls)
+	}
+	if stats := client.CacheStats(); stats.Hits != 2 || stats.Misses != 1 {
+		t.Errorf("CacheStats() = %+v; want 2 hits, 1 miss", stats)
+	}
+
+	// A successful apply refreshes the cache with the written records
+	create := []Record{{Type: "A", Name: "api", Targets: []string{"2.2.2.2"}}}
+	if err := client.ApplyChanges(context.Background(), create, nil); err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	readsAfterApply := fake.readCalls
+	records, err := client.ListRecords(context.Background())
+	if err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if fake.readCalls != readsAfterApply {
+		t.Errorf("ListRecords() after apply read the zone; want cache refresh")
+	}
+	if len(records) != 2 {
+		t.Errorf("ListRecords() after apply = %v; want 2 records", records)
+	}
+
+	// A failed apply invalidates the cache
+	fake.updateErr = errors.New("500 internal error")
+	if err := client.ApplyChanges(context.Background(), []Record{{Type: "A", Name: "x", Targets: []string{"3.3.3.3"}}}, nil); err == nil {
+		t.Fatal("ApplyChanges() expected error")
+	}
+	reads := fake.readCalls
+	if _, err := client.ListRecords(context.Background()); err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+	if fake.readCalls != reads+1 {
+		t.Errorf("ListRecords() after failed apply did not read the zone")
+	}
+}
+
+func TestListRecords_CacheDisabled(t *testing.T) {
+	fake := &fakeDNSService{readResp: &iaas.DNS{ID: 1, Name: "example.com"}}
+	client := &Client{Context: context.Background(), Service: fake, ZoneName: "example.com", ZoneID: 1}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.ListRecords(context.Background()); err != nil {
+			t.Fatalf("ListRecords() unexpected error: %v", err)
+		}
+	}
+	if fake.readCalls != 2 {
+		t.Errorf("readCalls = %d; want 2 without cache", fake.readCalls)
+	}
+}
+
+func TestZoneCache_DropsReadOverlappingApply(t *testing.T) {
+	var zc zoneCache
+	_, gen, ok := zc.get("example.com", time.Hour)
+	if ok {
+		t.Fatal("get() on an empty cache returned a hit")
+	}
+	written := []*iaas.DNSRecord{{Name: "new", Type: types.EDNSRecordType("A"), RData: "1.1.1.1"}}
+	zc.store(written)
+	zc.storeIfCurrent(gen, nil) // read that started before the apply
+
+	got, _, ok := zc.get("example.com", time.Hour)
+	if !ok || len(got) != 1 {
+		t.Errorf("cache = %v (hit=%v); want the records written by the apply", got, ok)
+	}
+}
+
+func TestListRecords_StaleWindow(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{
+			ID:   3,
+			Name: "stale.example",
+			Records: []*iaas.DNSRecord{
+				{Name: "www", Type: types.EDNSRecordType("A"), RData: "1.1.1.1", TTL: 300},
+			},
+		},
+	}
+	client := &Client{
+		Context:     context.Background(),
+		Service:     fake,
+		ZoneName:    "stale.example",
+		ZoneID:      3,
+		StaleWindow: time.Hour,
+	}
+	if _, err := client.ListRecords(context.Background()); err != nil {
+		t.Fatalf("ListRecords() unexpected error: %v", err)
+	}
+
+	outage := errors.New("503 service unavailable")
+	fake.readResp, fake.readErr = nil, outage
+	records, err := client.ListRecords(context.Background())
+	var stale *StaleError
+	if !errors.As(err, &stale) {
+		t.Fatalf("ListRecords() error = %v; want *StaleError", err)
+	}
+	if !errors.Is(err, outage) || stale.Zone != "stale.example" {
+		t.Errorf("StaleError = %+v; want zone stale.example wrapping the read error", stale)
+	}
+	want := []Record{{Type: "A", Name: "www", Targets: []string{"1.1.1.1"}, TTL: 300}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("stale records = %v; want %v", records, want)
+	}
+	if got := testutil.ToFloat64(metrics.StaleServes.WithLabelValues("stale.example")); got != 1 {
+		t.Errorf("stale serves = %v; want 1", got)
+	}
+
+	// Applies never use the snapshot
+	create := []Record{{Type: "A", Name: "api", Targets: []string{"2.2.2.2"}}}
+	if err := client.ApplyChanges(context.Background(), create, nil); !errors.Is(err, outage) {
+		t.Errorf("ApplyChanges() error = %v; want the read error", err)
+	}
+
+	// Beyond the window the error is returned as is
+	client.StaleWindow = time.Nanosecond
+	if records, err := client.ListRecords(context.Background()); records != nil || !errors.Is(err, outage) || errors.As(err, &stale) {
+		t.Errorf("ListRecords() = %v, %v; want no records and the plain read error", records, err)
+	}
+}
+
+func apiErr(code int) error {
+	return iaas.NewAPIError(http.MethodGet, nil, code, &iaas.APIErrorResponse{ErrorMessage: http.StatusText(code)})
+}
+
+func TestThrottle_Retries(t *testing.T) {
+	retries := func(reason string) float64 {
+		return testutil.ToFloat64(metrics.APIRetries.WithLabelValues("update", reason))
+	}
+	serverErrors, rateLimited := retries("server_error"), retries("rate_limited")
+
+	fake := &fakeDNSService{
+		updateErrSeq: []error{apiErr(http.StatusServiceUnavailable), apiErr(http.StatusTooManyRequests)},
+		updateResp:   &iaas.DNS{ID: 1},
+	}
+	svc := Throttle(fake, APIOptions{RetryBaseDelay: time.Millisecond, RetryMaxDelay: time.Millisecond})
+	if _, err := svc.UpdateWithContext(context.Background(), &dns.UpdateRequest{ID: 1}); err != nil {
+		t.Fatalf("UpdateWithContext() unexpected error: %v", err)
+	}
+	if fake.updateCalls != 3 {
+		t.Errorf("updateCalls = %d; want 3", fake.updateCalls)
+	}
+	if got := retries("server_error") - serverErrors; got != 1 {
+		t.Errorf("server_error retries = %v; want 1", got)
+	}
+	if got := retries("rate_limited") - rateLimited; got != 1 {
+		t.Errorf("rate_limited retries = %v; want 1", got)
+	}
+
+	// Conflicts are left to ApplyChanges
+	fake = &fakeDNSService{updateErr: conflictErr()}
+	svc = Throttle(fake, APIOptions{RetryBaseDelay: time.Millisecond})
+	if _, err := svc.UpdateWithContext(context.Background(), &dns.UpdateRequest{ID: 1}); !isConflictError(err) {
+		t.Errorf("UpdateWithContext() error = %v; want the conflict", err)
+	}
+	if fake.updateCalls != 1 {
+		t.Errorf("conflict updateCalls = %d; want 1", fake.updateCalls)
+	}
+
+	// Persistent errors give up after MaxRetries
+	outage := apiErr(http.StatusBadGateway)
+	fake = &fakeDNSService{readErr: outage}
+	svc = Throttle(fake, APIOptions{MaxRetries: 2, RetryBaseDelay: time.Millisecond})
+	if _, err := svc.ReadWithContext(context.Background(), &dns.ReadRequest{ID: 1}); !errors.Is(err, outage) {
+		t.Errorf("ReadWithContext() error = %v; want %v", err, outage)
+	}
+	if fake.readCalls != 3 {
+		t.Errorf("readCalls = %d; want 3", fake.readCalls)
+	}
+}
+
+func TestThrottle_StopsAtRequestDeadline(t *testing.T) {
+	outage := apiErr(http.StatusServiceUnavailable)
+	opts := APIOptions{MaxRetries: 10, RetryBaseDelay: time.Hour, RetryMaxDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// No backoff is started that would end past the deadline
+	fake := &fakeDNSService{readErr: outage}
+	if _, err := Throttle(fake, opts).ReadWithContext(ctx, &dns.ReadRequest{ID: 1}); !errors.Is(err, outage) {
+		t.Errorf("ReadWithContext() error = %v; want %v", err, outage)
+	}
+
+	// Detached updates keep the deadline of the request they came from
+	fake = &fakeDNSService{updateErr: outage}
+	start := time.Now()
+	if _, err := Throttle(fake, opts).UpdateWithContext(detach(ctx), &dns.UpdateRequest{ID: 1}); !errors.Is(err, outage) {
+		t.Errorf("UpdateWithContext() error = %v; want %v", err, outage)
+	}
+	if fake.updateCalls > 2 || time.Since(start) > time.Second {
+		t.Errorf("updateCalls = %d after %s; want the retries to stop at the deadline", fake.updateCalls, time.Since(start))
+	}
+}
+
+func TestThrottle_Backoff(t *testing.T) {
+	s := Throttle(nil, APIOptions{RetryBaseDelay: 10 * time.Millisecond, RetryMaxDelay: 50 * time.Millisecond}).(*throttledService)
+	for attempt, ceiling := range []time.Duration{10, 20, 40, 50, 50} {
+		ceiling *= time.Millisecond
+		if got := s.backoff(attempt, 0); got < 0 || got > ceiling {
+			t.Errorf("backoff(%d) = %v; want within [0, %v]", attempt, got, ceiling)
+		}
+	}
+	if got := s.backoff(0, 40*time.Millisecond); got < 40*time.Millisecond || got > 50*time.Millisecond {
+		t.Errorf("backoff with Retry-After = %v; want within [40ms, 50ms]", got)
+	}
+	if got := s.backoff(0, time.Hour); got != 50*time.Millisecond {
+		t.Errorf("backoff with a long Retry-After = %v; want capped at 50ms", got)
+	}
+}
+
+func TestRetryAfterTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "3")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	hint := &retryAfter{}
+	ctx := context.WithValue(context.Background(), retryAfterKey{}, hint)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	resp, err := newHTTPClient().Do(req)
+	if err != nil {
+		t.Fatalf("Do() unexpected error: %v", err)
+	}
+	resp.Body.Close() //nolint:errcheck
+	if got := hint.get(); got != 3*time.Second {
+		t.Errorf("Retry-After = %v; want 3s", got)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"Wed, 01 Jan 2025 00:00:30 GMT", 30 * time.Second, true},
+		{"Tue, 31 Dec 2024 23:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRetryAfter(tt.in, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(50, 2)
+	for i := 0; i < 2; i++ {
+		if wait, err := b.wait(context.Background()); wait != 0 || err != nil {
+			t.Fatalf("burst wait %d = %v, %v; want no wait", i, wait, err)
+		}
+	}
+	if wait, err := b.wait(context.Background()); wait <= 0 || err != nil {
+		t.Errorf("wait beyond burst = %v, %v; want a positive wait", wait, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait with cancelled context error = %v; want context.Canceled", err)
+	}
+}
+
+func TestNameMapping(t *testing.T) {
+	tests := []struct {
+		fqdn, zone, relative, back string
+	}{
+		{"example.com", "example.com", "@", "example.com"},
+		{"example.com.", "example.com", "@", "example.com"},
+		{"Example.COM", "example.com.", "@", "example.com"},
+		{"www.example.com", "example.com", "www", "www.example.com"},
+		{"WWW.Example.com.", "Example.com", "www", "www.example.com"},
+		{"*.example.com", "example.com", "*", "*.example.com"},
+		{"*.dev.example.com.", "example.com", "*.dev", "*.dev.example.com"},
+		{"a.b.example.com", "example.com", "a.b", "a.b.example.com"},
+		{"api.prod.example.com", "prod.example.com", "api", "api.prod.example.com"},
+		// Only whole labels are trimmed
+		{"notexample.com", "example.com", "notexample.com", "notexample.com.example.com"},
+		// Relative names pass through normalized
+		{"www", "example.com", "www", "www.example.com"},
+		{"@", "example.com", "@", "example.com"},
+	}
+	for _, tt := range tests {
+		rel := RelativeName(tt.fqdn, tt.zone)
+		if rel != tt.relative {
+			t.Errorf("RelativeName(%q, %q) = %q; want %q", tt.fqdn, tt.zone, rel, tt.relative)
+		}
+		if got := FQDN(rel, tt.zone); got != tt.back {
+			t.Errorf("FQDN(%q, %q) = %q; want %q", rel, tt.zone, got, tt.back)
+		}
+	}
+
+	if got := FQDN("", "example.com."); got != "example.com" {
+		t.Errorf("FQDN(\"\") = %q; want the zone", got)
+	}
+	// Record names are relative even when they end with the zone name
+	if got := FQDN("www.example.com", "example.com"); got != "www.example.com.example.com" {
+		t.Errorf("FQDN of a relative name ending with the zone = %q", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	tests := []struct {
+		name        string
+		create, del []Record
+		want        []string // reasons
+	}{
+		{"valid", []Record{
+			{Type: "A", Name: "www", Targets: []string{"192.0.2.1"}, TTL: 300},
+			{Type: "AAAA", Name: "www", Targets: []string{"2001:db8::1"}},
+			{Type: "CNAME", Name: "api", Targets: []string{"lb.example.net."}, TTL: 60},
+		}, nil, nil},
+		{"no targets", []Record{{Type: "A", Name: "www"}}, nil, []string{"no targets"}},
+		{"delete without targets", nil, []Record{{Type: "A", Name: "www"}}, []string{"no targets"}},
+		{"bad IPv4", []Record{{Type: "A", Name: "www", Targets: []string{"192.0.2.1", "2001:db8::1", "x"}}},
+			nil, []string{"not an IPv4 address", "not an IPv4 address"}},
+		{"bad IPv6", []Record{{Type: "AAAA", Name: "www", Targets: []string{"192.0.2.1"}}}, nil, []string{"not an IPv6 address"}},
+		{"TTL", []Record{{Type: "A", Name: "www", Targets: []string{"192.0.2.1"}, TTL: 5}}, nil, []string{"TTL 5 is outside 10..3600000"}},
+		{"long name", []Record{{Type: "A", Name: strings.Join([]string{long, long, long, long}, "."), Targets: []string{"192.0.2.1"}}},
+			nil, []string{"name is longer than 253 octets"}},
+		{"long label", []Record{{Type: "A", Name: long + "a", Targets: []string{"192.0.2.1"}}},
+			nil, []string{"name has an empty label or one longer than 63 octets"}},
+		{"multi-target CNAME", []Record{{Type: "CNAME", Name: "www", Targets: []string{"a.example.net.", "b.example.net."}}},
+			nil, []string{"CNAME must have exactly one target"}},
+		{"CNAME and A", []Record{
+			{Type: "CNAME", Name: "www", Targets: []string{"lb.example.net."}},
+			{Type: "A", Name: "WWW", Targets: []string{"192.0.2.1"}},
+		}, nil, []string{"CNAME cannot coexist with A at the same name"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, p := range Validate("example.com", tt.create, tt.del) {
+			got = append(got, p.Reason)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Validate() reasons = %q; want %q", tt.name, got, tt.want)
+		}
+	}
+
+	p := Validate("example.com", []Record{{Type: "A", Name: "@", Targets: []string{"x"}}}, nil)
+	if want := (Problem{DNSName: "example.com", RecordType: "A", Target: "x", Reason: "not an IPv4 address"}); len(p) != 1 || p[0] != want {
+		t.Errorf("Validate() = %+v; want %+v", p, want)
+	}
+}
+
+func TestApplyChanges_CNAMECoexistence(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{ID: 1, Records: []*iaas.DNSRecord{
+			{Name: "www", Type: types.EDNSRecordType("A"), RData: "192.0.2.1", TTL: 300},
+		}},
+	}
+	client := &Client{Context: context.Background(), Service: fake, ZoneName: "example.com", ZoneID: 1}
+
+	create := []Record{{Type: "CNAME", Name: "www", Targets: []string{"lb.example.net."}}}
+	err := client.ApplyChanges(context.Background(), create, nil)
+	var invalid *ValidationError
+	if !errors.As(err, &invalid) {
+		t.Fatalf("ApplyChanges() error = %v; want *ValidationError", err)
+	}
+	if len(invalid.Problems) != 1 || invalid.Problems[0].DNSName != "www.example.com" {
+		t.Errorf("problems = %+v; want one for www.example.com", invalid.Problems)
+	}
+	if fake.updateCalls != 0 {
+		t.Errorf("updateCalls = %d; want 0", fake.updateCalls)
+	}
+
+	// Replacing the A record in the same batch is fine
+	del := []Record{{Type: "A", Name: "www", Targets: []string{"192.0.2.1"}}}
+	if err := client.ApplyChanges(context.Background(), create, del); err != nil {
+		t.Errorf("ApplyChanges() replacing A with CNAME: %v", err)
+	}
+}
+
+func TestCheckChanges_CNAMECoexistence(t *testing.T) {
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{ID: 1, Records: []*iaas.DNSRecord{
+			{Name: "www", Type: types.EDNSRecordType("A"), RData: "192.0.2.1", TTL: 300},
+		}},
+	}
+	client := &Client{Context: context.Background(), Service: fake, ZoneName: "example.com", ZoneID: 1}
+
+	create := []Record{{Type: "CNAME", Name: "www", Targets: []string{"lb.example.net."}}}
+	var invalid *ValidationError
+	if err := client.CheckChanges(context.Background(), create, nil); !errors.As(err, &invalid) {
+		t.Errorf("CheckChanges() error = %v; want *ValidationError", err)
+	}
+	del := []Record{{Type: "A", Name: "www", Targets: []string{"192.0.2.1"}}}
+	if err := client.CheckChanges(context.Background(), create, del); err != nil {
+		t.Errorf("CheckChanges() replacing A with CNAME: %v", err)
+	}
+	if fake.updateCalls != 0 {
+		t.Errorf("updateCalls = %d; want 0", fake.updateCalls)
+	}
+}
+
+func TestApplyChanges_DeletionLimits(t *testing.T) {
+	zone := func() *iaas.DNS {
+		return &iaas.DNS{ID: 1, Records: []*iaas.DNSRecord{
+			{Name: "a", Type: types.EDNSRecordType("A"), RData: "192.0.2.1", TTL: 300},
+			{Name: "b", Type: types.EDNSRecordType("A"), RData: "192.0.2.2", TTL: 300},
+			{Name: "c", Type: types.EDNSRecordType("A"), RData: "192.0.2.3", TTL: 300},
+			{Name: "d", Type: types.EDNSRecordType("A"), RData: "192.0.2.4", TTL: 300},
+		}}
+	}
+	del := []Record{
+		{Type: "A", Name: "a", Targets: []string{"192.0.2.1"}},
+		{Type: "A", Name: "b", Targets: []string{"192.0.2.2"}},
+		{Type: "A", Name: "c", Targets: []string{"192.0.2.3"}},
+	}
+	refused := func() float64 { return testutil.ToFloat64(metrics.DeletionsRefused.WithLabelValues("limits.example")) }
+
+	tests := []struct {
+		name     string
+		max      int
+		percent  float64
+		override bool
+		create   []Record
+		wantOK   bool
+	}{
+		{"no limits", 0, 0, false, nil, true},
+		{"count", 2, 0, false, nil, false},
+		{"percent", 0, 50, false, nil, false},
+		{"within limits", 3, 75, false, nil, true},
+		{"override", 1, 0, true, nil, true},
+		{"updates are not deletions", 1, 0, false, []Record{
+			{Type: "A", Name: "a", Targets: []string{"198.51.100.1"}},
+			{Type: "A", Name: "b", Targets: []string{"198.51.100.2"}},
+		}, true},
+	}
+	for _, tt := range tests {
+		fake := &fakeDNSService{readResp: zone(), updateResp: &iaas.DNS{ID: 1}}
+		client := &Client{
+			Context:            context.Background(),
+			Service:            fake,
+			ZoneName:           "limits.example",
+			ZoneID:             1,
+			MaxDeletions:       tt.max,
+			MaxDeletionPercent: tt.percent,
+			AllowMassDeletion:  tt.override,
+		}
+		// The pre-flight check refuses the same updates without writing
+		if err := client.CheckChanges(context.Background(), tt.create, del); errors.Is(err, ErrDeletionLimit) == tt.wantOK || fake.updateCalls != 0 {
+			t.Errorf("%s: CheckChanges() = %v with %d updates; want refused=%v and no update", tt.name, err, fake.updateCalls, !tt.wantOK)
+		}
+		before := refused()
+
+		err := client.ApplyChanges(context.Background(), tt.create, del)
+		if tt.wantOK {
+			if err != nil || fake.updateCalls != 1 {
+				t.Errorf("%s: ApplyChanges() = %v with %d updates; want one update", tt.name, err, fake.updateCalls)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrDeletionLimit) || fake.updateCalls != 0 {
+			t.Errorf("%s: ApplyChanges() = %v with %d updates; want ErrDeletionLimit and no update", tt.name, err, fake.updateCalls)
+		}
+		if got := refused() - before; got != 1 {
+			t.Errorf("%s: refused updates = %v; want 1", tt.name, got)
+		}
+	}
+}
+
+func TestProtectRule(t *testing.T) {
+	tests := []struct {
+		rule       string
+		recType    string
+		name       string
+		want       bool
+		wantString string
+	}{
+		{"MX:@", "MX", "@", true, "MX:@"},
+		{"MX:@", "A", "@", false, "MX:@"},
+		{"mx:example.com", "MX", "@", true, "MX:example.com"},
+		{"TXT:_acme-challenge*", "TXT", "_acme-challenge.www", true, "TXT:_acme-challenge*"},
+		{"TXT:_acme-challenge*", "TXT", "www", false, "TXT:_acme-challenge*"},
+		{"*._domainkey", "TXT", "s1._domainkey", true, "*:*._domainkey"},
+		{"*:*._domainkey.example.com", "CNAME", "S1._DomainKey", true, "*:*._domainkey.example.com"},
+		{"NS:@", "NS", "www", false, "NS:@"},
+		{"TXT:/^(_dmarc|_mta-sts)$/", "TXT", "_dmarc", true, "TXT:/^(_dmarc|_mta-sts)$/"},
+		{"TXT:/^(_dmarc|_mta-sts)$/", "TXT", "_dmarc.www", false, "TXT:/^(_dmarc|_mta-sts)$/"},
+	}
+	for _, tt := range tests {
+		rule, err := ParseProtectRule(tt.rule)
+		if err != nil {
+			t.Fatalf("ParseProtectRule(%q) unexpected error: %v", tt.rule, err)
+		}
+		if got := rule.Matches(tt.recType, tt.name, "example.com"); got != tt.want {
+			t.Errorf("%q.Matches(%s, %s) = %v; want %v", tt.rule, tt.recType, tt.name, got, tt.want)
+		}
+		if got := rule.String(); got != tt.wantString {
+			t.Errorf("%q.String() = %q; want %q", tt.rule, got, tt.wantString)
+		}
+	}
+
+	for _, bad := range []string{"", "TXT:", "TXT:[", "A:/(/"} {
+		if _, err := ParseProtectRule(bad); err == nil {
+			t.Errorf("ParseProtectRule(%q) expected error", bad)
+		}
+	}
+}
+
+func TestApplyChanges_ProtectedRecords(t *testing.T) {
+	rules, err := ParseProtectRules([]string{"MX:@", "TXT:_acme-challenge*"})
+	if err != nil {
+		t.Fatalf("ParseProtectRules() unexpected error: %v", err)
+	}
+	fake := &fakeDNSService{
+		readResp: &iaas.DNS{ID: 1, Records: []*iaas.DNSRecord{
+			{Name: "@", Type: types.EDNSRecordType("MX"), RData: "10 mail.example.com.", TTL: 3600},
+			{Name: "_acme-challenge", Type: types.EDNSRecordType("TXT"), RData: "token", TTL: 60},
+			{Name: "www", Type: types.EDNSRecordType("A"), RData: "192.0.2.1", TTL: 300},
+		}},
+		updateResp: &iaas.DNS{ID: 1},
+	}
+	client := &Client{Context: context.Background(), Service: fake, ZoneName: "example.com", ZoneID: 1, ProtectRules: rules}
+
+	for _, change := range []struct{ create, del []Record }{
+		{del: []Record{{Type: "MX", Name: "@", Targets: []string{"10 mail.example.com."}}}},
+		{create: []Record{{Type: "TXT", Name: "_acme-challenge.www", Targets: []string{"other"}}}},
+	} {
+		if err := client.CheckProtected(change.create, change.del); !errors.Is(err, ErrProtectedRecord) {
+			t.Errorf("CheckProtected(%+v) error = %v; want ErrProtectedRecord", change, err)
+		}
+		if err := client.ApplyChanges(context.Background(), change.create, change.del); !errors.Is(err, ErrProtectedRecord) {
+			t.Errorf("ApplyChanges(%+v) error = %v; want ErrProtectedRecord", change, err)
+		}
+	}
+	if fake.readCalls != 0 || fake.updateCalls != 0 {
+		t.Errorf("protected changes reached the API: %d reads, %d updates", fake.readCalls, fake.updateCalls)
+	}
+
+	create := []Record{{Type: "A", Name: "api", Targets: []string{"192.0.2.2"}}}
+	if err := client.ApplyChanges(context.Background(), create, nil); err != nil {
+		t.Fatalf("ApplyChanges() unexpected error: %v", err)
+	}
+	if got := len(fake.lastUpdateReq.Records); got != 4 {
+		t.Errorf("updated zone has %d records; want the protected ones kept", got)
+	}
+
+	records, err := client.ListRecords(context.Background())
+	if err != nil || len(records) != 3 {
+		t.Errorf("ListRecords() = %d records, %v; want all 3 while not hidden", len(records), err)
+	}
+	client.HideProtected = true
+	records, err = client.ListRecords(context.Background())
+	if err != nil || len(records) != 1 || records[0].Name != "www" {
+		t.Errorf("ListRecords() = %+v, %v; want only www", records, err)
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
+)
+
+// applyQueue serializes ApplyChanges calls for one zone. Waiters are
+// admitted in arrival order, since blocked channel senders are queued FIFO.
+// The zero value is ready to use.
+type applyQueue struct {
+	once sync.Once
+	slot chan struct{}
+}
+
+// acquire blocks until the caller owns zone or ctx is done, and returns how
+// long it waited. The wait of every successful call is observed in
+// metrics.ApplyQueueWait.
+func (q *applyQueue) acquire(ctx context.Context, zone string) (time.Duration, error) {
+	q.once.Do(func() { q.slot = make(chan struct{}, 1) })
+
+	start := time.Now()
+	select {
+	case q.slot <- struct{}{}:
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+	wait := time.Since(start)
+	metrics.ApplyQueueWait.WithLabelValues(zone).Observe(wait.Seconds())
+	return wait, nil
+}
+
+// release hands the zone to the next waiter.
+func (q *applyQueue) release() {
+	<-q.slot
+}
@@ -0,0 +1,211 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	iaas "github.com/sacloud/iaas-api-go"
+)
+
+// MXData is the parsed form of an MX RData value: "<preference> <exchange>".
+type MXData struct {
+	Preference uint16
+	Exchange   string // FQDN with trailing dot
+}
+
+// ParseMX parses an MX value such as "10 mail.example.com".
+// The preference must be within 0-65535 and the exchange host gets a
+// trailing dot; its case is kept as given.
+func ParseMX(rdata string) (MXData, error) {
+	fields := strings.Fields(rdata)
+	if len(fields) != 2 {
+		return MXData{}, fmt.Errorf("invalid MX value %q: want \"<preference> <exchange>\"", rdata)
+	}
+	pref, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return MXData{}, fmt.Errorf("invalid MX preference %q: must be an integer between 0 and 65535", fields[0])
+	}
+	return MXData{
+		Preference: uint16(pref),
+		Exchange:   fqdn(fields[1]),
+	}, nil
+}
+
+// String formats the MX value as SakuraCloud RData.
+func (m MXData) String() string {
+	return fmt.Sprintf("%d %s", m.Preference, m.Exchange)
+}
+
+// SRVData is the parsed form of an SRV RData value:
+// "<priority> <weight> <port> <target>".
+type SRVData struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string // FQDN with trailing dot
+}
+
+// ParseSRV parses an SRV value such as "10 5 5060 sip.example.com".
+// Priority, weight and port must each be within 0-65535 and the target host
+// gets a trailing dot; its case is kept as given.
+func ParseSRV(rdata string) (SRVData, error) {
+	fields := strings.Fields(rdata)
+	if len(fields) != 4 {
+		return SRVData{}, fmt.Errorf("invalid SRV value %q: want \"<priority> <weight> <port> <target>\"", rdata)
+	}
+	var nums [3]uint16
+	for i, label := range []string{"priority", "weight", "port"} {
+		n, err := strconv.ParseUint(fields[i], 10, 16)
+		if err != nil {
+			return SRVData{}, fmt.Errorf("invalid SRV %s %q: must be an integer between 0 and 65535", label, fields[i])
+		}
+		nums[i] = uint16(n)
+	}
+	return SRVData{
+		Priority: nums[0],
+		Weight:   nums[1],
+		Port:     nums[2],
+		Target:   fqdn(fields[3]),
+	}, nil
+}
+
+// String formats the SRV value as SakuraCloud RData.
+func (s SRVData) String() string {
+	return fmt.Sprintf("%d %d %d %s", s.Priority, s.Weight, s.Port, s.Target)
+}
+
+// caaTags lists the CAA property tags accepted by SakuraCloud.
+var caaTags = map[string]bool{
+	"issue":     true,
+	"issuewild": true,
+	"iodef":     true,
+}
+
+// CAAData is the parsed form of a CAA RData value: `<flags> <tag> "<value>"`.
+type CAAData struct {
+	Flags uint8
+	Tag   string // one of issue, issuewild, iodef (lower case)
+	Value string // unquoted value
+}
+
+// ParseCAA parses a CAA value such as `0 issue "letsencrypt.org"`.
+// Flags must be within 0-255, the tag must be issue, issuewild or iodef and
+// the value may be given with or without surrounding double quotes.
+func ParseCAA(rdata string) (CAAData, error) {
+	fields := strings.Fields(rdata)
+	if len(fields) < 3 {
+		return CAAData{}, fmt.Errorf("invalid CAA value %q: want `<flags> <tag> \"<value>\"`", rdata)
+	}
+	flags, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return CAAData{}, fmt.Errorf("invalid CAA flags %q: must be an integer between 0 and 255", fields[0])
+	}
+	tag := strings.ToLower(fields[1])
+	if !caaTags[tag] {
+		return CAAData{}, fmt.Errorf("invalid CAA tag %q: must be one of issue, issuewild, iodef", fields[1])
+	}
+	value := strings.Join(fields[2:], " ")
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	if strings.Contains(value, `"`) {
+		return CAAData{}, fmt.Errorf("invalid CAA value %q: unbalanced or embedded quotes", fields[2])
+	}
+	return CAAData{
+		Flags: uint8(flags),
+		Tag:   tag,
+		Value: value,
+	}, nil
+}
+
+// String formats the CAA value as SakuraCloud RData.
+func (c CAAData) String() string {
+	return fmt.Sprintf(`%d %s "%s"`, c.Flags, c.Tag, c.Value)
+}
+
+// fqdn ensures a host name ends with a trailing dot.
+func fqdn(host string) string {
+	if !strings.HasSuffix(host, ".") {
+		host += "."
+	}
+	return host
+}
+
+// canonicalRData returns the canonical form of rdata for the given record
+// type so values written by us and values read back from SakuraCloud can be
+// compared reliably. Structured values are compared field by field, so
+// cosmetic differences such as extra whitespace do not matter. Host names
+// keep their case, so GET /records reports them as they were written; see
+// rdataEqual for comparisons. Values that cannot be parsed are returned
+// unchanged.
+func canonicalRData(recType, rdata string) string {
+	switch recType {
+	case "CNAME", "ALIAS", "NS":
+		if host := strings.TrimSpace(rdata); host != "" {
+			return fqdn(host)
+		}
+	case "A", "AAAA":
+		// IPv6 addresses have many textual forms ("2001:db8::1" vs
+		// "2001:0db8:0:0:0:0:0:1"); use the RFC 5952 representation. An
+		// IPv4-mapped AAAA value stays mapped, as external-dns sends it.
+		if addr, err := netip.ParseAddr(rdata); err == nil {
+			if recType == "A" {
+				addr = addr.Unmap()
+			}
+			return addr.String()
+		}
+	case "MX":
+		if mx, err := ParseMX(rdata); err == nil {
+			return mx.String()
+		}
+	case "SRV":
+		if srv, err := ParseSRV(rdata); err == nil {
+			return srv.String()
+		}
+	case "CAA":
+		if caa, err := ParseCAA(rdata); err == nil {
+			return caa.String()
+		}
+	}
+	return rdata
+}
+
+// rdataEqual reports whether two RData values of recType are equivalent.
+// Values holding a host name are compared case-insensitively.
+func rdataEqual(recType, a, b string) bool {
+	switch recType {
+	case "CNAME", "ALIAS", "NS", "MX", "SRV":
+		return strings.EqualFold(canonicalRData(recType, a), canonicalRData(recType, b))
+	}
+	return canonicalRData(recType, a) == canonicalRData(recType, b)
+}
+
+// recordMatches reports whether the zone record rs is described by rec,
+// comparing type, name (case-insensitively) and any of rec's targets.
+func recordMatches(rs *iaas.DNSRecord, rec Record) bool {
+	if string(rs.Type) != rec.Type || !strings.EqualFold(rs.Name, rec.Name) {
+		return false
+	}
+	for _, target := range rec.Targets {
+		if rdataEqual(rec.Type, rs.RData, target) {
+			return true
+		}
+	}
+	return false
+}
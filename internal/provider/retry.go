@@ -0,0 +1,335 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	iaas "github.com/sacloud/iaas-api-go"
+	"github.com/sacloud/iaas-service-go/dns"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
+)
+
+const (
+	// DefaultAPITimeout bounds a single SakuraCloud API request.
+	DefaultAPITimeout = 30 * time.Second
+	// DefaultAPIRateLimit is the sustained number of API calls per second.
+	DefaultAPIRateLimit = 5.0
+	// DefaultAPIBurst is how many API calls may be made at once before
+	// DefaultAPIRateLimit applies.
+	DefaultAPIBurst = 10
+	// DefaultAPIMaxRetries is how many times a retryable API error is retried.
+	DefaultAPIMaxRetries = 4
+	// DefaultAPIRetryBaseDelay is the backoff ceiling of the first retry; it
+	// doubles on every further attempt up to DefaultAPIRetryMaxDelay.
+	DefaultAPIRetryBaseDelay = 500 * time.Millisecond
+	// DefaultAPIRetryMaxDelay caps the backoff between two attempts.
+	DefaultAPIRetryMaxDelay = 30 * time.Second
+)
+
+// APIOptions configures the SakuraCloud API client shared by all zones.
+// Zero values fall back to the matching Default* constant.
+type APIOptions struct {
+	Timeout        time.Duration // per-request timeout
+	RateLimit      float64       // sustained API calls per second
+	Burst          int           // token bucket size
+	MaxRetries     int           // retries of 429, 5xx and timeout errors
+	RetryBaseDelay time.Duration // backoff ceiling of the first retry
+	RetryMaxDelay  time.Duration // backoff cap, also applied to Retry-After
+}
+
+// withDefaults returns o with its zero values replaced by the defaults.
+func (o APIOptions) withDefaults() APIOptions {
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultAPITimeout
+	}
+	if o.RateLimit <= 0 {
+		o.RateLimit = DefaultAPIRateLimit
+	}
+	if o.Burst <= 0 {
+		o.Burst = DefaultAPIBurst
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = DefaultAPIMaxRetries
+	}
+	if o.RetryBaseDelay <= 0 {
+		o.RetryBaseDelay = DefaultAPIRetryBaseDelay
+	}
+	if o.RetryMaxDelay <= 0 {
+		o.RetryMaxDelay = DefaultAPIRetryMaxDelay
+	}
+	return o
+}
+
+// throttledService wraps a DNSService so that every attempt takes a token
+// from a shared bucket, and retryable errors are retried with exponential
+// backoff and full jitter, honouring the Retry-After of the response.
+type throttledService struct {
+	next    DNSService
+	opts    APIOptions
+	limiter *tokenBucket
+}
+
+// Throttle returns svc wrapped with the rate limit and retry policy of opts.
+// Retry-After is only known when the underlying HTTP client goes through
+// retryAfterTransport, as the one built by NewClients does.
+func Throttle(svc DNSService, opts APIOptions) DNSService {
+	opts = opts.withDefaults()
+	return &throttledService{
+		next:    svc,
+		opts:    opts,
+		limiter: newTokenBucket(opts.RateLimit, opts.Burst),
+	}
+}
+
+func (s *throttledService) FindWithContext(ctx context.Context, req *dns.FindRequest) ([]*iaas.DNS, error) {
+	return retryCall(ctx, s, "find", func(ctx context.Context) ([]*iaas.DNS, error) {
+		return s.next.FindWithContext(ctx, req)
+	})
+}
+
+func (s *throttledService) ReadWithContext(ctx context.Context, req *dns.ReadRequest) (*iaas.DNS, error) {
+	return retryCall(ctx, s, "read", func(ctx context.Context) (*iaas.DNS, error) {
+		return s.next.ReadWithContext(ctx, req)
+	})
+}
+
+// UpdateWithContext retries like the other calls: an update replaces the
+// whole record set guarded by its SettingsHash, so repeating one that did
+// land surfaces as a conflict rather than a double apply.
+func (s *throttledService) UpdateWithContext(ctx context.Context, req *dns.UpdateRequest) (*iaas.DNS, error) {
+	return retryCall(ctx, s, "update", func(ctx context.Context) (*iaas.DNS, error) {
+		return s.next.UpdateWithContext(ctx, req)
+	})
+}
+
+// retryCall runs call until it succeeds, fails with a non-retryable error,
+// runs out of retries or ctx is done. It also gives up when the backoff
+// would end past the deadline of ctx, or of the request a detached ctx
+// was derived from, so retries never outlive the webhook request.
+func retryCall[T any](ctx context.Context, s *throttledService, operation string, call func(context.Context) (T, error)) (T, error) {
+	logger := logging.FromContext(ctx).With("operation", operation)
+	for attempt := 0; ; attempt++ {
+		var zero T
+		wait, err := s.limiter.wait(ctx)
+		if err != nil {
+			return zero, err
+		}
+		if wait > 0 {
+			logger.Debug("throttled SakuraCloud API call", "wait", wait)
+		}
+
+		hint := &retryAfter{}
+		result, err := call(context.WithValue(ctx, retryAfterKey{}, hint))
+		if err == nil {
+			if attempt > 0 {
+				logger.Info("SakuraCloud API call succeeded after retries", "retries", attempt)
+			}
+			return result, nil
+		}
+		reason := retryReason(ctx, err)
+		if reason == "" {
+			return result, err
+		}
+		if attempt >= s.opts.MaxRetries {
+			logger.Warn("SakuraCloud API call failed, giving up",
+				"retries", attempt, "reason", reason, logging.KeyError, err)
+			return result, err
+		}
+
+		backoff := s.backoff(attempt, hint.get())
+		if deadline, ok := retryDeadline(ctx); ok && time.Now().Add(backoff).After(deadline) {
+			logger.Warn("SakuraCloud API call failed, giving up before the request deadline",
+				"retries", attempt, "reason", reason, "backoff", backoff, logging.KeyError, err)
+			return result, err
+		}
+		metrics.APIRetries.WithLabelValues(operation, reason).Inc()
+		logger.Warn("SakuraCloud API call failed, retrying",
+			"attempt", attempt+1, "max_attempts", s.opts.MaxRetries+1,
+			"reason", reason, "backoff", backoff, logging.KeyError, err)
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// backoff returns the wait before retry attempt+1: a random duration up to
+// RetryBaseDelay doubled per attempt, or the server's Retry-After when that
+// is longer, capped at RetryMaxDelay so that a retry never waits unbounded.
+func (s *throttledService) backoff(attempt int, retryAfter time.Duration) time.Duration {
+	ceiling := s.opts.RetryMaxDelay
+	if attempt < 32 && s.opts.RetryBaseDelay<<attempt < ceiling {
+		ceiling = s.opts.RetryBaseDelay << attempt
+	}
+	wait := rand.N(ceiling + 1)
+	return min(max(wait, retryAfter), s.opts.RetryMaxDelay)
+}
+
+// retryReason classifies err for retries and metrics; it returns "" for
+// errors that must not be retried, including the caller giving up.
+func retryReason(ctx context.Context, err error) string {
+	if ctx.Err() != nil {
+		return ""
+	}
+	var apiErr iaas.APIError
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.ResponseCode(); {
+		case code == http.StatusTooManyRequests:
+			return "rate_limited"
+		case code == http.StatusLocked:
+			return "locked"
+		case code >= http.StatusInternalServerError:
+			return "server_error"
+		}
+		return ""
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return ""
+}
+
+// deadlineKey is the context key of the request deadline kept by detach.
+type deadlineKey struct{}
+
+// detach returns a context that is never cancelled, for calls that must not
+// be aborted half-way, but keeps the deadline of ctx for retryCall.
+func detach(ctx context.Context) context.Context {
+	detached := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		detached = context.WithValue(detached, deadlineKey{}, deadline)
+	}
+	return detached
+}
+
+// retryDeadline returns the deadline retries of ctx must end by.
+func retryDeadline(ctx context.Context) (time.Time, bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		return deadline, true
+	}
+	deadline, ok := ctx.Value(deadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// tokenBucket is a context-aware token bucket limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// wait takes a token, blocking until one is available or ctx is done, and
+// reports how long it waited. Tokens are reserved in order, so a cancelled
+// waiter hands its token back.
+func (b *tokenBucket) wait(ctx context.Context) (time.Duration, error) {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	var delay time.Duration
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if delay == 0 {
+		return 0, nil
+	}
+	select {
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens++
+		b.mu.Unlock()
+		return delay, ctx.Err()
+	case <-time.After(delay):
+		return delay, nil
+	}
+}
+
+// retryAfterKey is the context key of the *retryAfter of one API attempt.
+type retryAfterKey struct{}
+
+// retryAfter carries the Retry-After of a failed response from the HTTP
+// transport back to retryCall.
+type retryAfter struct {
+	d atomic.Int64
+}
+
+func (r *retryAfter) get() time.Duration { return time.Duration(r.d.Load()) }
+
+// retryAfterTransport records the Retry-After header of 429 and 5xx
+// responses in the retryAfter of the request context.
+type retryAfterTransport struct {
+	next http.RoundTripper
+}
+
+func (t *retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode < http.StatusTooManyRequests {
+		return resp, err
+	}
+	hint, ok := req.Context().Value(retryAfterKey{}).(*retryAfter)
+	if !ok {
+		return resp, err
+	}
+	if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		hint.d.Store(int64(d))
+	}
+	return resp, err
+}
+
+// parseRetryAfter parses a Retry-After value given in seconds or as an
+// HTTP date.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(v); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// newHTTPClient returns the HTTP client of the SakuraCloud API. Its
+// transport feeds Retry-After to Throttle.
+func newHTTPClient() *http.Client {
+	return &http.Client{Transport: &retryAfterTransport{next: http.DefaultTransport}}
+}
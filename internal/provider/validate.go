@@ -0,0 +1,180 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package provider
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	iaas "github.com/sacloud/iaas-api-go"
+)
+
+const (
+	// MinTTL and MaxTTL bound the record TTLs SakuraCloud accepts, in
+	// seconds. A zero TTL is allowed and means the default of 3600.
+	MinTTL = 10
+	MaxTTL = 3600000
+
+	// maxNameLength is the longest DNS name in octets, without the
+	// trailing dot, and maxLabelLength the longest label (RFC 1035).
+	maxNameLength  = 253
+	maxLabelLength = 63
+)
+
+// Problem describes why one endpoint of a change batch cannot be applied.
+type Problem struct {
+	DNSName    string `json:"dnsName"`
+	RecordType string `json:"recordType"`
+	Target     string `json:"target,omitempty"`
+	Reason     string `json:"reason"`
+}
+
+// ValidationError is returned by ApplyChanges when the resulting zone would
+// break DNS or SakuraCloud rules. Nothing is written to the zone.
+type ValidationError struct {
+	Zone     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 0 {
+		return fmt.Sprintf("invalid changes for zone %s", e.Zone)
+	}
+	p := e.Problems[0]
+	msg := fmt.Sprintf("invalid changes for zone %s: %s %s: %s", e.Zone, p.DNSName, p.RecordType, p.Reason)
+	if len(e.Problems) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Problems)-1)
+	}
+	return msg
+}
+
+// Validate checks the records to create in zone against the rules that do
+// not depend on the zone's current contents: at least one target, names of
+// at most 253 octets and labels of at most 63, TTLs within MinTTL..MaxTTL,
+// IPv4 targets for A and IPv6 for AAAA, a single target for CNAME and ALIAS,
+// and no CNAME sharing its name with another record of the batch. Records
+// to delete must have at least one target, too.
+func Validate(zone string, create, del []Record) []Problem {
+	var problems []Problem
+	report := func(rec Record, target, reason string) {
+		problems = append(problems, Problem{
+			DNSName:    FQDN(rec.Name, zone),
+			RecordType: rec.Type,
+			Target:     target,
+			Reason:     reason,
+		})
+	}
+
+	for _, rec := range create {
+		fqdn := FQDN(rec.Name, zone)
+		if len(fqdn) > maxNameLength {
+			report(rec, "", fmt.Sprintf("name is longer than %d octets", maxNameLength))
+		}
+		for _, label := range strings.Split(fqdn, ".") {
+			if label == "" || len(label) > maxLabelLength {
+				report(rec, "", fmt.Sprintf("name has an empty label or one longer than %d octets", maxLabelLength))
+				break
+			}
+		}
+		if rec.TTL != 0 && (rec.TTL < MinTTL || rec.TTL > MaxTTL) {
+			report(rec, "", fmt.Sprintf("TTL %d is outside %d..%d", rec.TTL, MinTTL, MaxTTL))
+		}
+		if len(rec.Targets) == 0 {
+			report(rec, "", "no targets")
+			continue
+		}
+
+		switch rec.Type {
+		case "A", "AAAA":
+			family := "IPv4"
+			if rec.Type == "AAAA" {
+				family = "IPv6"
+			}
+			for _, t := range rec.Targets {
+				addr, err := netip.ParseAddr(t)
+				if err != nil || addr.Zone() != "" || (rec.Type == "A") != addr.Is4() {
+					report(rec, t, "not an "+family+" address")
+				}
+			}
+		case "CNAME", "ALIAS":
+			if len(rec.Targets) > 1 {
+				report(rec, "", fmt.Sprintf("%s must have exactly one target", rec.Type))
+			}
+		}
+	}
+
+	for _, rec := range del {
+		if len(rec.Targets) == 0 {
+			report(rec, "", "no targets")
+		}
+	}
+
+	for _, rec := range create {
+		if rec.Type != "CNAME" {
+			continue
+		}
+		for _, other := range create {
+			if other.Type != "CNAME" && strings.EqualFold(other.Name, rec.Name) {
+				report(rec, "", fmt.Sprintf("CNAME cannot coexist with %s at the same name", other.Type))
+				break
+			}
+		}
+	}
+	return problems
+}
+
+// validateZone checks the record set about to be written for CNAMEs sharing
+// their name with any other record. Only names in create are reported, so a
+// zone that already breaks the rule elsewhere can still be updated.
+func validateZone(zone string, sets []*iaas.DNSRecord, create []Record) []Problem {
+	var problems []Problem
+	seen := map[string]bool{}
+	for _, cRec := range create {
+		if seen[strings.ToLower(cRec.Name)] {
+			continue
+		}
+		seen[strings.ToLower(cRec.Name)] = true
+
+		var cnames, others int
+		var otherType string
+		for _, rs := range sets {
+			if !strings.EqualFold(rs.Name, cRec.Name) {
+				continue
+			}
+			if rs.Type == "CNAME" {
+				cnames++
+			} else {
+				others++
+				otherType = string(rs.Type)
+			}
+		}
+		switch {
+		case cnames > 0 && others > 0:
+			problems = append(problems, Problem{
+				DNSName:    FQDN(cRec.Name, zone),
+				RecordType: cRec.Type,
+				Reason:     fmt.Sprintf("CNAME cannot coexist with %s at the same name", otherType),
+			})
+		case cnames > 1:
+			problems = append(problems, Problem{
+				DNSName:    FQDN(cRec.Name, zone),
+				RecordType: cRec.Type,
+				Reason:     "more than one CNAME at the same name",
+			})
+		}
+	}
+	return problems
+}
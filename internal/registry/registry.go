@@ -0,0 +1,263 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"errors"
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// DefaultPrefix is the TXT registry prefix used by a nil Registry.
+const DefaultPrefix = "_external-dns."
+
+// recordTemplate is replaced by the lower-cased record type in the prefix
+// or suffix, following external-dns --txt-prefix/--txt-suffix semantics.
+const recordTemplate = "%{record_type}"
+
+// knownTypes lists the record types external-dns encodes into registry
+// TXT names ("<prefix><type>-<name>").
+var knownTypes = []string{"A", "AAAA", "CNAME", "NS", "MX", "SRV", "CAA", "TXT"}
+
+// Registry identifies external-dns TXT registry records and enforces that
+// only records owned by OwnerID are modified through this webhook.
+//
+// Registry names are derived the same way external-dns does: the prefix is
+// prepended to, or the suffix appended to, the first label of the endpoint
+// name, and "%{record_type}" in either is replaced by the record type. When
+// neither contains the template, "<type>-" is prepended to the first label.
+//
+// A nil *Registry is valid: it uses DefaultPrefix and enforces nothing.
+type Registry struct {
+	// OwnerID is the owner ID of this webhook. Empty disables ownership checks.
+	OwnerID string
+	// Prefix is prepended to the first label of registry TXT record names.
+	Prefix string
+	// Suffix is appended to the first label of registry TXT record names.
+	// Prefix and Suffix are mutually exclusive.
+	Suffix string
+	// WildcardReplacement replaces a leading "*" label in registry names.
+	WildcardReplacement string
+}
+
+// Conflict describes an endpoint the webhook refused to modify because it
+// is owned by another external-dns instance.
+type Conflict struct {
+	DNSName    string `json:"dnsName"`
+	RecordType string `json:"recordType"`
+	Owner      string `json:"owner"`
+}
+
+// Owners maps lower-cased DNS names to the owner ID recorded for them.
+type Owners map[string]string
+
+// Validate reports configuration errors external-dns would also reject.
+func (r *Registry) Validate() error {
+	if r != nil && r.Prefix != "" && r.Suffix != "" {
+		return errors.New("txt-prefix and txt-suffix are mutually exclusive")
+	}
+	return nil
+}
+
+// Enforced reports whether ownership checks are enabled.
+func (r *Registry) Enforced() bool {
+	return r != nil && r.OwnerID != ""
+}
+
+// affixes returns the lower-cased prefix and suffix.
+func (r *Registry) affixes() (prefix, suffix string) {
+	if r == nil {
+		return DefaultPrefix, ""
+	}
+	return strings.ToLower(r.Prefix), strings.ToLower(r.Suffix)
+}
+
+// IsRegistryName reports whether dnsName can be the name of a registry TXT record.
+func (r *Registry) IsRegistryName(dnsName string) bool {
+	_, _, ok := r.EndpointName(dnsName)
+	return ok
+}
+
+// txtName returns the name of the registry TXT record guarding the
+// endpoint dnsName of recordType.
+func (r *Registry) txtName(dnsName, recordType string) string {
+	prefix, suffix := r.affixes()
+	labels := strings.SplitN(strings.ToLower(strings.TrimSuffix(dnsName, ".")), ".", 2)
+	recordType = strings.ToLower(recordType)
+
+	if r != nil && r.WildcardReplacement != "" && labels[0] == "*" {
+		labels[0] = r.WildcardReplacement
+	}
+	if !strings.Contains(prefix+suffix, recordTemplate) {
+		labels[0] = recordType + "-" + labels[0]
+	}
+	prefix = strings.ReplaceAll(prefix, recordTemplate, recordType)
+	suffix = strings.ReplaceAll(suffix, recordTemplate, recordType)
+
+	if len(labels) < 2 {
+		return prefix + labels[0] + suffix
+	}
+	return prefix + labels[0] + suffix + "." + labels[1]
+}
+
+// EndpointName returns the lower-cased DNS name and record type guarded by
+// the registry TXT record txtName. The record type is empty for old-format
+// names that do not encode it. ok is false when txtName does not carry the
+// configured prefix or suffix.
+func (r *Registry) EndpointName(txtName string) (name, recordType string, ok bool) {
+	prefix, suffix := r.affixes()
+	lower := strings.ToLower(strings.TrimSuffix(txtName, "."))
+
+	switch {
+	case suffix == "":
+		name, recordType = dropAffix(lower, prefix, "")
+	case prefix == "":
+		// The suffix may itself contain dots, so it spans several labels
+		dc := strings.Count(suffix, ".")
+		labels := strings.SplitN(lower, ".", 2+dc)
+		if len(labels) < 1+dc {
+			return "", "", false
+		}
+		name, recordType = dropAffix(strings.Join(labels[:1+dc], "."), "", suffix)
+		if name != "" && len(labels) == 2+dc {
+			name += "." + labels[1+dc]
+		}
+	}
+	if name == "" {
+		return "", "", false
+	}
+
+	if r != nil && r.WildcardReplacement != "" {
+		first, rest, _ := strings.Cut(name, ".")
+		if first == strings.ToLower(r.WildcardReplacement) {
+			name = strings.TrimSuffix("*."+rest, ".")
+		}
+	}
+	return name, recordType, true
+}
+
+// dropAffix strips prefix (or suffix) from name and extracts the record type
+// encoded either by the "%{record_type}" template or by a "<type>-" marker.
+func dropAffix(name, prefix, suffix string) (base, recordType string) {
+	if strings.Contains(prefix+suffix, recordTemplate) {
+		for _, t := range knownTypes {
+			tLower := strings.ToLower(t)
+			p := strings.ReplaceAll(prefix, recordTemplate, tLower)
+			s := strings.ReplaceAll(suffix, recordTemplate, tLower)
+			if suffix == "" && strings.HasPrefix(name, p) {
+				return strings.TrimPrefix(name, p), t
+			}
+			if suffix != "" && strings.HasSuffix(name, s) {
+				return strings.TrimSuffix(name, s), t
+			}
+		}
+		// Old-format names written before the template was introduced
+		prefix = strings.ReplaceAll(prefix, recordTemplate, "")
+		suffix = strings.ReplaceAll(suffix, recordTemplate, "")
+	}
+
+	if suffix == "" && strings.HasPrefix(name, prefix) {
+		return extractTypeMarker(strings.TrimPrefix(name, prefix))
+	}
+	if suffix != "" && strings.HasSuffix(name, suffix) {
+		return extractTypeMarker(strings.TrimSuffix(name, suffix))
+	}
+	return "", ""
+}
+
+// extractTypeMarker strips a leading "<type>-" marker from name.
+func extractTypeMarker(name string) (base, recordType string) {
+	for _, t := range knownTypes {
+		if marker := strings.ToLower(t) + "-"; strings.HasPrefix(name, marker) {
+			return strings.TrimPrefix(name, marker), t
+		}
+	}
+	return name, ""
+}
+
+// Owner extracts the owner ID from the content of a registry TXT record.
+// It accepts both "external-dns/owner=<id>" and the short "owner=<id>" form
+// and reports false when the content is not an external-dns heritage record.
+func Owner(txt string) (string, bool) {
+	heritage := false
+	owner := ""
+	for _, token := range strings.Split(strings.Trim(txt, `"`), ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(token), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "heritage":
+			heritage = val == "external-dns"
+		case "external-dns/" + endpoint.OwnerLabelKey, endpoint.OwnerLabelKey:
+			owner = val
+		}
+	}
+	if !heritage || owner == "" {
+		return "", false
+	}
+	return owner, true
+}
+
+// Owners indexes the owners recorded by registry TXT records among current.
+// Both the guarded endpoint name and the TXT record name itself are mapped
+// to the owner, so neither can be modified by another owner.
+func (r *Registry) Owners(current []*endpoint.Endpoint) Owners {
+	owners := Owners{}
+	for _, ep := range current {
+		if ep == nil || ep.RecordType != endpoint.RecordTypeTXT || !r.IsRegistryName(ep.DNSName) {
+			continue
+		}
+		for _, t := range ep.Targets {
+			owner, ok := Owner(t)
+			if !ok {
+				continue
+			}
+			if name, _, ok := r.EndpointName(ep.DNSName); ok {
+				owners[normalize(name)] = owner
+			}
+			owners[normalize(ep.DNSName)] = owner
+			break
+		}
+	}
+	return owners
+}
+
+// Check returns a Conflict for every endpoint whose name is owned by an
+// owner other than r.OwnerID. It returns nil when ownership is not enforced.
+func (r *Registry) Check(endpoints []*endpoint.Endpoint, owners Owners) []Conflict {
+	if !r.Enforced() {
+		return nil
+	}
+	var conflicts []Conflict
+	for _, ep := range endpoints {
+		if ep == nil {
+			continue
+		}
+		if owner, ok := owners[normalize(ep.DNSName)]; ok && owner != r.OwnerID {
+			conflicts = append(conflicts, Conflict{
+				DNSName:    ep.DNSName,
+				RecordType: ep.RecordType,
+				Owner:      owner,
+			})
+		}
+	}
+	return conflicts
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,137 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestOwner(t *testing.T) {
+	cases := []struct {
+		in     string
+		want   string
+		wantOK bool
+	}{
+		{`"heritage=external-dns,external-dns/owner=cluster-a,external-dns/resource=ingress/default/web"`, "cluster-a", true},
+		{"heritage=external-dns,owner=default", "default", true},
+		{"heritage=other,external-dns/owner=cluster-a", "", false},
+		{"v=spf1 -all", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := Owner(tc.in)
+		if got != tc.want || ok != tc.wantOK {
+			t.Errorf("Owner(%q) = (%q, %v); want (%q, %v)", tc.in, got, ok, tc.want, tc.wantOK)
+		}
+	}
+}
+
+func TestEndpointName(t *testing.T) {
+	cases := []struct {
+		reg      *Registry
+		in       string
+		want     string
+		wantType string
+		wantOK   bool
+	}{
+		{nil, "_external-dns.cname-foo.example.com", "foo.example.com", "CNAME", true},
+		{nil, "_external-dns.a-www.example.com", "www.example.com", "A", true},
+		{nil, "_external-dns.www.example.com", "www.example.com", "", true},
+		{nil, "www.example.com", "", "", false},
+		{&Registry{}, "aaaa-www.example.com", "www.example.com", "AAAA", true},
+		{&Registry{Prefix: "%{record_type}-reg."}, "cname-reg.foo.example.com", "foo.example.com", "CNAME", true},
+		{&Registry{Suffix: "-reg"}, "a-www-reg.example.com", "www.example.com", "A", true},
+		{&Registry{Suffix: ".%{record_type}.reg"}, "www.mx.reg.example.com", "www.example.com", "MX", true},
+		{&Registry{Suffix: "-reg"}, "www.example.com", "", "", false},
+		{&Registry{Prefix: "txt.", WildcardReplacement: "any"}, "txt.a-any.example.com", "*.example.com", "A", true},
+	}
+	for _, tc := range cases {
+		got, gotType, ok := tc.reg.EndpointName(tc.in)
+		if got != tc.want || gotType != tc.wantType || ok != tc.wantOK {
+			t.Errorf("%+v EndpointName(%q) = (%q, %q, %v); want (%q, %q, %v)",
+				tc.reg, tc.in, got, gotType, ok, tc.want, tc.wantType, tc.wantOK)
+		}
+	}
+}
+
+func Test_txtName(t *testing.T) {
+	cases := []struct {
+		reg  *Registry
+		name string
+		typ  string
+		want string
+	}{
+		{nil, "www.example.com", "A", "_external-dns.a-www.example.com"},
+		{&Registry{}, "www.example.com", "CNAME", "cname-www.example.com"},
+		{&Registry{Prefix: "%{record_type}-reg."}, "www.example.com", "AAAA", "aaaa-reg.www.example.com"},
+		{&Registry{Suffix: "-reg"}, "www.example.com", "A", "a-www-reg.example.com"},
+		{&Registry{Suffix: ".%{record_type}.reg"}, "www.example.com", "MX", "www.mx.reg.example.com"},
+		{&Registry{Prefix: "txt.", WildcardReplacement: "any"}, "*.example.com", "A", "txt.a-any.example.com"},
+		{&Registry{Suffix: "-reg"}, "example", "A", "a-example-reg"},
+	}
+	for _, tc := range cases {
+		got := tc.reg.txtName(tc.name, tc.typ)
+		if got != tc.want {
+			t.Errorf("%+v txtName(%q, %q) = %q; want %q", tc.reg, tc.name, tc.typ, got, tc.want)
+			continue
+		}
+		// Every generated name must map back to the endpoint it guards
+		back, backType, ok := tc.reg.EndpointName(got)
+		if !ok || back != tc.name || backType != tc.typ {
+			t.Errorf("%+v EndpointName(%q) = (%q, %q, %v); want (%q, %q, true)",
+				tc.reg, got, back, backType, ok, tc.name, tc.typ)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := (&Registry{Prefix: "p.", Suffix: "-s"}).Validate(); err == nil {
+		t.Error("Validate() expected error when both prefix and suffix are set")
+	}
+	if err := (&Registry{Suffix: "-s"}).Validate(); err != nil {
+		t.Errorf("Validate() unexpected error: %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	reg := &Registry{OwnerID: "cluster-a", Prefix: DefaultPrefix}
+	current := []*endpoint.Endpoint{
+		{DNSName: "_external-dns.a-mine.example.com", RecordType: "TXT", Targets: endpoint.Targets{"heritage=external-dns,external-dns/owner=cluster-a"}},
+		{DNSName: "_external-dns.a-theirs.example.com", RecordType: "TXT", Targets: endpoint.Targets{"heritage=external-dns,external-dns/owner=cluster-b"}},
+		{DNSName: "theirs.example.com", RecordType: "A", Targets: endpoint.Targets{"1.1.1.1"}},
+	}
+	owners := reg.Owners(current)
+
+	changes := []*endpoint.Endpoint{
+		{DNSName: "mine.example.com", RecordType: "A"},
+		{DNSName: "theirs.example.com", RecordType: "A"},
+		{DNSName: "_external-dns.a-theirs.example.com", RecordType: "TXT"},
+		{DNSName: "unowned.example.com", RecordType: "A"},
+	}
+	got := reg.Check(changes, owners)
+	want := []Conflict{
+		{DNSName: "theirs.example.com", RecordType: "A", Owner: "cluster-b"},
+		{DNSName: "_external-dns.a-theirs.example.com", RecordType: "TXT", Owner: "cluster-b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Check() = %#v; want %#v", got, want)
+	}
+
+	if got := (&Registry{}).Check(changes, owners); got != nil {
+		t.Errorf("Check() without owner ID = %#v; want nil", got)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/metrics"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/tracing"
+)
+
+// readinessProbeTimeout bounds the zone reads a "/readyz" request may trigger.
+const readinessProbeTimeout = 5 * time.Second
+
+// readiness is the body of the "/readyz" response.
+type readiness struct {
+	Status string                `json:"status"`
+	Zones  []provider.ZoneHealth `json:"zones"`
+}
+
+// NewHealthMux returns an http.ServeMux serving only the health and metrics
+// routes, for the separate listener recommended by the webhook spec.
+func NewHealthMux(clients []*provider.Client) *http.ServeMux {
+	mux := http.NewServeMux()
+	registerHealthRoutes(mux, clients)
+	return mux
+}
+
+// route wraps h with a server span, request logging fields and metrics for path.
+func route(path string, h http.HandlerFunc) http.HandlerFunc {
+	return tracing.Middleware(path, logging.Middleware(path, metrics.InstrumentRoute(path, h)))
+}
+
+// registerHealthRoutes adds "/healthz", "/readyz" and "/metrics" to mux.
+func registerHealthRoutes(mux *http.ServeMux, clients []*provider.Client) {
+	// Liveness "/healthz"
+	mux.HandleFunc("/healthz", route("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
+		w.WriteHeader(http.StatusOK)
+		if _, err := fmt.Fprint(w, `{"status":"ok"}`); err != nil {
+			logging.FromContext(r.Context()).Warn("failed to write healthz response", logging.KeyError, err)
+		}
+	}))
+
+	// Readiness "/readyz"; 503 unless every zone can be read and written
+	mux.HandleFunc("/readyz", route("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessProbeTimeout)
+		defer cancel()
+
+		resp := readiness{Status: "ok", Zones: make([]provider.ZoneHealth, 0, len(clients))}
+		code := http.StatusOK
+		for _, c := range clients {
+			zh := c.Health(ctx)
+			if !zh.Ready {
+				resp.Status = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+			resp.Zones = append(resp.Zones, zh)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logging.FromContext(r.Context()).Warn("failed to write readyz response", logging.KeyError, err)
+		}
+	}))
+
+	// Prometheus metrics "/metrics"
+	mux.Handle("/metrics", metrics.Handler())
+}
@@ -15,92 +15,293 @@
 package server
 
 import (
-	"fmt"
-	"log"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/config"
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/handler"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/registry"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/tracing"
 )
 
-// NewMux returns an http.ServeMux with all webhook routes registered.
-func NewMux(client *provider.Client, cfg config.Config) *http.ServeMux {
+// DefaultRequestTimeout is how long a webhook request may take when no
+// timeout is configured.
+const DefaultRequestTimeout = 60 * time.Second
+
+// writeTimeoutMargin is added to the write timeout of the webhook listener
+// on top of the request timeout and one SakuraCloud API call.
+const writeTimeoutMargin = 5 * time.Second
+
+// supportedRecordTypes lists the record types advertised during negotiation.
+var supportedRecordTypes = []string{"A", "AAAA", "CAA", "CNAME", "MX", "SRV", "TXT"}
+
+// negotiation is the body of the "/" negotiation response.
+type negotiation struct {
+	DomainFilter []string `json:"domainFilter"`
+	RecordTypes  []string `json:"recordTypes"`
+}
+
+// NewMux returns an http.ServeMux with all webhook routes registered,
+// including the health and metrics routes of NewHealthMux unless
+// cfg.HealthPort configures a separate health listener.
+// Each client serves one zone; endpoints are routed to the client whose
+// zone is the longest suffix of the endpoint name.
+func NewMux(clients []*provider.Client, cfg config.Config) *http.ServeMux {
+	return newMux(clients, cfg, &drainGate{})
+}
+
+// newMux is NewMux with POST /records admitted through gate, so that no new
+// apply starts once shutdown has begun.
+func newMux(clients []*provider.Client, cfg config.Config, gate *drainGate) *http.ServeMux {
 	mux := http.NewServeMux()
 
-	// Negotiation endpoint "/"
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[Filter] %s %s", r.Method, r.URL.Path)
-		w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
-		w.WriteHeader(http.StatusOK)
-		if _, err := fmt.Fprintf(w, `{"domainFilter":["%s"],"recordTypes":["A","CNAME","TXT"]}`, cfg.ZoneName); err != nil {
-			log.Printf("[Filter] write negotiation response failed: %v", err)
-		}
-	})
+	providers := make([]handler.Provider, 0, len(clients))
+	for _, c := range clients {
+		providers = append(providers, c)
+	}
+	zones := handler.NewZones(providers...)
+	zones.AliasApexCNAME = cfg.ApexCNAMEAlias
 
-	// Health check "/healthz"
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[Healthz] %s %s", r.Method, r.URL.Path)
+	reg := newRegistry(cfg)
+	timeout := requestTimeout(cfg)
+
+	// Negotiation endpoint "/", matched exactly so that other paths 404
+	mux.HandleFunc("/{$}", route("/", func(w http.ResponseWriter, r *http.Request) {
+		logging.FromContext(r.Context()).Debug("negotiation requested")
 		w.Header().Set("Content-Type", "application/external.dns.webhook+json;version=1")
 		w.WriteHeader(http.StatusOK)
-		if _, err := fmt.Fprint(w, `{"status":"ok"}`); err != nil {
-			log.Printf("[Healthz] write healthz response failed: %v", err)
+		resp := negotiation{
+			DomainFilter: zones.Names(),
+			RecordTypes:  supportedRecordTypes,
 		}
-	})
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			logging.FromContext(r.Context()).Warn("failed to write negotiation response", logging.KeyError, err)
+		}
+	}))
+
+	// Health checks and metrics, served here only when no separate
+	// health listener is configured
+	if cfg.HealthPort == "" {
+		registerHealthRoutes(mux, clients)
+	}
 
 	// Records listing & applying "/records"
-	mux.HandleFunc("/records", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[Records] %s %s", r.Method, r.URL.Path)
+	mux.HandleFunc("/records", route("/records", withTimeout(timeout, func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			handler.RecordsHandler(client)(w, r)
-			log.Printf("[Records] GET /records invoked")
+			handler.RecordsHandler(zones)(w, r)
 		case http.MethodPost:
-			handler.ApplyHandler(client)(w, r)
-			log.Printf("[Records] POST /records invoked")
+			if !gate.enter() {
+				logging.FromContext(r.Context()).Warn("refusing apply: shutting down")
+				http.Error(w, "shutting down", http.StatusServiceUnavailable)
+				return
+			}
+			defer gate.leave()
+			handler.ApplyHandler(zones, reg)(w, r)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	})))
+
+	// Planned or applied zone diffs "/plan"
+	mux.HandleFunc("/plan", route("/plan", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		diffs := []*provider.ZoneDiff{}
+		for _, c := range clients {
+			if d := c.LastDiff(); d != nil {
+				diffs = append(diffs, d)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(diffs); err != nil {
+			logging.FromContext(r.Context()).Warn("failed to write plan response", logging.KeyError, err)
+		}
+	}))
 
 	// Adjust endpoints "/adjustendpoints"
-	mux.HandleFunc("/adjustendpoints", func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("[Adjust] %s %s", r.Method, r.URL.Path)
-		handler.AdjustHandler(client)(w, r)
-	})
+	mux.HandleFunc("/adjustendpoints", route("/adjustendpoints", withTimeout(timeout, func(w http.ResponseWriter, r *http.Request) {
+		handler.AdjustHandler(zones, reg)(w, r)
+	})))
 
 	return mux
 }
 
-// Run initializes the client and starts the HTTP server.
+// withTimeout bounds the request context of h by timeout, so that waiting for
+// the apply queue and retrying SakuraCloud API calls end before the webhook
+// listener's write timeout.
+func withTimeout(timeout time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h(w, r.WithContext(ctx))
+	}
+}
+
+// requestTimeout returns the configured request timeout or its default.
+func requestTimeout(cfg config.Config) time.Duration {
+	if cfg.RequestTimeout > 0 {
+		return cfg.RequestTimeout
+	}
+	return DefaultRequestTimeout
+}
+
+// writeTimeout returns the write timeout of the webhook listener. A zone
+// update is never cancelled half-way, so the last one started before the
+// request timeout may still take a full SakuraCloud API timeout.
+func writeTimeout(cfg config.Config) time.Duration {
+	apiTimeout := cfg.ApiTimeout
+	if apiTimeout <= 0 {
+		apiTimeout = provider.DefaultAPITimeout
+	}
+	return requestTimeout(cfg) + apiTimeout + writeTimeoutMargin
+}
+
+// isUnspecified reports whether host listens on every interface.
+func isUnspecified(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// newRegistry builds the TXT registry naming and ownership settings from cfg.
+// The prefix falls back to registry.DefaultPrefix when neither a prefix nor a
+// suffix is configured. Ownership is only enforced when the TXT registry is
+// enabled.
+func newRegistry(cfg config.Config) *registry.Registry {
+	prefix := cfg.TxtPrefix
+	if prefix == "" && cfg.TxtSuffix == "" {
+		prefix = registry.DefaultPrefix
+	}
+	reg := &registry.Registry{
+		Prefix:              prefix,
+		Suffix:              cfg.TxtSuffix,
+		WildcardReplacement: cfg.TxtWildcardReplacement,
+	}
+	if cfg.RegistryTXT {
+		reg.OwnerID = cfg.TxtOwnerID
+	}
+	return reg
+}
+
+// Run initializes the clients and serves HTTP until SIGTERM or SIGINT,
+// then shuts down gracefully.
 func Run(cfg config.Config) {
-	if cfg.ZoneName == "" {
-		log.Fatal("[Server] ZONE environment variable is required")
+	zoneNames := cfg.Zones()
+	if len(zoneNames) == 0 {
+		fatal("ZONE_NAME or ZONE_NAMES environment variable is required")
+	}
+	slog.Info("using DNS zones", "zones", zoneNames)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.OtlpEndpoint)
+	if err != nil {
+		fatal("failed to set up tracing", logging.KeyError, err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			slog.Warn("failed to flush traces", logging.KeyError, err)
+		}
+	}()
+	if cfg.OtlpEndpoint != "" {
+		slog.Info("exporting traces via OTLP", "endpoint", cfg.OtlpEndpoint)
 	}
-	log.Printf("[Server] Using DNS zone: %s", cfg.ZoneName)
 
-	log.Printf("[Server] Initializing SakuraCloud DNS client")
-	client, err := provider.NewClient(cfg.ZoneName, cfg.SakuraApiToken, cfg.SakuraApiSecret)
+	clientMap, err := provider.NewClients(zoneNames, cfg.SakuraApiToken, cfg.SakuraApiSecret, provider.APIOptions{
+		Timeout:        cfg.ApiTimeout,
+		RateLimit:      cfg.ApiRateLimit,
+		Burst:          cfg.ApiBurst,
+		MaxRetries:     cfg.ApiMaxRetries,
+		RetryBaseDelay: cfg.ApiRetryBaseDelay,
+		RetryMaxDelay:  cfg.ApiRetryMaxDelay,
+	})
+	if err != nil {
+		fatal("failed to create SakuraCloud client", logging.KeyError, err)
+	}
+	protectRules, err := provider.ParseProtectRules(cfg.ProtectRecords)
 	if err != nil {
-		log.Fatalf("[Server] Failed to create SakuraCloud client: %v", err)
+		fatal("invalid protected record rule", logging.KeyError, err)
+	}
+	if len(protectRules) > 0 {
+		slog.Info("protecting records", "rules", cfg.ProtectRecords, "hidden", cfg.HideProtectedRecords)
 	}
 
+	clients := make([]*provider.Client, 0, len(zoneNames))
+	for _, name := range zoneNames {
+		c := clientMap[name]
+		c.DryRun = cfg.DryRun
+		c.HealthMaxAge = cfg.ReadinessMaxAge
+		c.CacheTTL = cfg.RecordsCacheTTL
+		c.StaleWindow = cfg.StaleRecordsWindow
+		c.MaxDeletions = cfg.MaxDeletions
+		c.MaxDeletionPercent = cfg.MaxDeletionPercent
+		c.AllowMassDeletion = cfg.AllowMassDeletion
+		c.ProtectRules = protectRules
+		c.HideProtected = cfg.HideProtectedRecords
+		clients = append(clients, c)
+	}
+	if cfg.DryRun {
+		slog.Info("dry-run mode enabled: zone changes are logged and exposed at /plan but not applied")
+	}
+
+	if err := newRegistry(cfg).Validate(); err != nil {
+		fatal("invalid TXT registry configuration", logging.KeyError, err)
+	}
 	if cfg.RegistryTXT {
-		log.Printf("[Server] TXT registry enabled, owner ID: %s", cfg.TxtOwnerID)
+		slog.Info("TXT registry enabled, enforcing ownership",
+			"owner_id", cfg.TxtOwnerID, "prefix", cfg.TxtPrefix, "suffix", cfg.TxtSuffix)
 	}
 
-	mux := NewMux(client, cfg)
-	addr := fmt.Sprintf("%s:%s", cfg.ProviderIP, cfg.ProviderPort)
-	srv := &http.Server{
-		Addr:         addr,
-		Handler:      mux,
+	gate := &drainGate{}
+	servers := []*http.Server{{
+		Addr:         net.JoinHostPort(cfg.ProviderIP, cfg.ProviderPort),
+		Handler:      newMux(clients, cfg, gate),
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: writeTimeout(cfg),
 		IdleTimeout:  120 * time.Second,
+	}}
+	if ip := net.ParseIP(cfg.ProviderIP); ip == nil || !ip.IsLoopback() {
+		slog.Warn("webhook API is reachable from outside the pod; set --provider-ip=127.0.0.1 to restrict it", "provider_ip", cfg.ProviderIP)
 	}
-	log.Printf("[Server] Starting webhook HTTP server at %s", addr)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("[Server] HTTP server error: %v", err)
+	if cfg.HealthPort != "" {
+		healthAddr := net.JoinHostPort(cfg.HealthIP, cfg.HealthPort)
+		if cfg.HealthPort == cfg.ProviderPort && (cfg.HealthIP == cfg.ProviderIP || isUnspecified(cfg.HealthIP) || isUnspecified(cfg.ProviderIP)) {
+			fatal("health listener overlaps the webhook listener; use a different --health-port", "addr", healthAddr)
+		}
+		slog.Info("serving health checks and metrics on a separate listener", "addr", healthAddr)
+		servers = append(servers, &http.Server{
+			Addr:         healthAddr,
+			Handler:      NewHealthMux(clients),
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 10 * time.Second,
+			IdleTimeout:  120 * time.Second,
+		})
 	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := serve(ctx, gate, cfg.ShutdownTimeout, servers...); err != nil {
+		fatal("HTTP server error", logging.KeyError, err)
+	}
+}
+
+// fatal logs msg at error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
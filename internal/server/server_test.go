@@ -15,20 +15,28 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
+
+	iaas "github.com/sacloud/iaas-api-go"
+	"github.com/sacloud/iaas-service-go/dns"
 
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/config"
 	"github.com/sacloud/external-dns-sacloud-webhook/internal/provider"
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/registry"
 )
 
 func TestRootEndpoint(t *testing.T) {
 	cfg := config.Config{ZoneName: "test.com"}
 	client := &provider.Client{ZoneName: cfg.ZoneName}
-	mux := NewMux(client, cfg)
+	mux := NewMux([]*provider.Client{client}, cfg)
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -42,7 +50,26 @@ func TestRootEndpoint(t *testing.T) {
 		t.Errorf("unexpected Content-Type: %q", contentType)
 	}
 	body, _ := io.ReadAll(rr.Body)
-	want := `{"domainFilter":["test.com"],"recordTypes":["A","CNAME","TXT"]}`
+	want := `{"domainFilter":["test.com"],"recordTypes":["A","AAAA","CAA","CNAME","MX","SRV","TXT"]}`
+	if strings.TrimSpace(string(body)) != want {
+		t.Errorf("body = %q; want %q", string(body), want)
+	}
+}
+
+func TestRootEndpoint_MultipleZones(t *testing.T) {
+	cfg := config.Config{ZoneNames: []string{"example.com", "example.jp"}}
+	clients := []*provider.Client{
+		{ZoneName: "example.com"},
+		{ZoneName: "example.jp"},
+	}
+	mux := NewMux(clients, cfg)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	mux.ServeHTTP(rr, req)
+
+	body, _ := io.ReadAll(rr.Body)
+	want := `{"domainFilter":["example.com","example.jp"],"recordTypes":["A","AAAA","CAA","CNAME","MX","SRV","TXT"]}`
 	if strings.TrimSpace(string(body)) != want {
 		t.Errorf("body = %q; want %q", string(body), want)
 	}
@@ -51,7 +78,7 @@ func TestRootEndpoint(t *testing.T) {
 func TestHealthzEndpoint(t *testing.T) {
 	cfg := config.Config{ZoneName: "whatever"}
 	client := &provider.Client{ZoneName: cfg.ZoneName}
-	mux := NewMux(client, cfg)
+	mux := NewMux([]*provider.Client{client}, cfg)
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
@@ -70,7 +97,7 @@ func TestNotAllowedMethod(t *testing.T) {
 	// Sending a PUT request to the /records endpoint should return 405
 	cfg := config.Config{ZoneName: "z"}
 	client := &provider.Client{ZoneName: cfg.ZoneName}
-	mux := NewMux(client, cfg)
+	mux := NewMux([]*provider.Client{client}, cfg)
 
 	rr := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodPut, "/records", nil)
@@ -80,3 +107,219 @@ func TestNotAllowedMethod(t *testing.T) {
 		t.Errorf("PUT /records returned %d; want 405", rr.Code)
 	}
 }
+
+func TestPlanEndpoint_Empty(t *testing.T) {
+	cfg := config.Config{ZoneName: "example.com", DryRun: true}
+	client := &provider.Client{ZoneName: cfg.ZoneName, DryRun: true}
+	mux := NewMux([]*provider.Client{client}, cfg)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/plan", nil)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /plan returned %d; want 200", rr.Code)
+	}
+	body, _ := io.ReadAll(rr.Body)
+	if strings.TrimSpace(string(body)) != `[]` {
+		t.Errorf("body = %q; want []", string(body))
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := config.Config{ZoneName: "example.com"}
+	client := &provider.Client{ZoneName: cfg.ZoneName}
+	mux := NewMux([]*provider.Client{client}, cfg)
+
+	// Hit a route first so it shows up in the request metrics
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	mux.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("GET /metrics returned %d; want 200", rr.Code)
+	}
+	body, _ := io.ReadAll(rr.Body)
+	want := `sacloud_webhook_http_requests_total{code="200",method="GET",route="/healthz"}`
+	if !strings.Contains(string(body), want) {
+		t.Errorf("metrics output does not contain %s", want)
+	}
+}
+
+func TestMux_HealthRoutesOnHealthListenerOnly(t *testing.T) {
+	cfg := config.Config{ZoneName: "example.com", HealthPort: "8080"}
+	client := &provider.Client{ZoneName: cfg.ZoneName}
+	mux := NewMux([]*provider.Client{client}, cfg)
+
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("GET %s with a health listener returned %d; want 404", path, rr.Code)
+		}
+	}
+}
+
+// fakeDNSService answers zone reads with readErr or an empty zone.
+type fakeDNSService struct {
+	readErr error
+}
+
+func (f *fakeDNSService) FindWithContext(ctx context.Context, req *dns.FindRequest) ([]*iaas.DNS, error) {
+	return nil, nil
+}
+
+func (f *fakeDNSService) ReadWithContext(ctx context.Context, req *dns.ReadRequest) (*iaas.DNS, error) {
+	if f.readErr != nil {
+		return nil, f.readErr
+	}
+	return &iaas.DNS{ID: req.ID}, nil
+}
+
+func (f *fakeDNSService) UpdateWithContext(ctx context.Context, req *dns.UpdateRequest) (*iaas.DNS, error) {
+	return &iaas.DNS{ID: req.ID, Records: req.Records}, nil
+}
+
+func TestHealthMux(t *testing.T) {
+	client := &provider.Client{ZoneName: "example.com", Service: &fakeDNSService{}}
+	mux := NewHealthMux([]*provider.Client{client})
+
+	for _, path := range []string{"/healthz", "/readyz", "/metrics"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("GET %s returned %d; want 200", path, rr.Code)
+		}
+	}
+
+	// The provider API must not be reachable on the health listener
+	for _, path := range []string{"/", "/records", "/adjustendpoints"} {
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("POST %s returned %d; want 404", path, rr.Code)
+		}
+	}
+}
+
+func TestReadyzEndpoint_Unavailable(t *testing.T) {
+	clients := []*provider.Client{
+		{ZoneName: "example.com", Service: &fakeDNSService{}},
+		{ZoneName: "example.jp", Service: &fakeDNSService{readErr: errors.New("zone not found")}},
+	}
+	mux := NewHealthMux(clients)
+
+	rr := httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("GET /readyz returned %d; want 503", rr.Code)
+	}
+	var resp readiness
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode readyz response: %v", err)
+	}
+	if resp.Status != "unavailable" || len(resp.Zones) != 2 {
+		t.Fatalf("readyz = %+v; want unavailable with 2 zones", resp)
+	}
+	if !resp.Zones[0].Ready || resp.Zones[1].Ready {
+		t.Errorf("zone readiness = %v/%v; want true/false", resp.Zones[0].Ready, resp.Zones[1].Ready)
+	}
+	if resp.Zones[1].LastError != "zone not found" {
+		t.Errorf("lastError = %q; want %q", resp.Zones[1].LastError, "zone not found")
+	}
+}
+
+func TestRecordsPost_RefusedDuringShutdown(t *testing.T) {
+	cfg := config.Config{ZoneName: "example.com"}
+	client := &provider.Client{ZoneName: cfg.ZoneName, Service: &fakeDNSService{}}
+	gate := &drainGate{}
+	mux := newMux([]*provider.Client{client}, cfg, gate)
+	gate.close()
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(`{}`))
+	mux.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("POST /records during shutdown returned %d; want 503", rr.Code)
+	}
+
+	// Reads keep working while in-flight applies drain
+	rr = httptest.NewRecorder()
+	mux.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/records", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("GET /records during shutdown returned %d; want 200", rr.Code)
+	}
+}
+
+func TestServe_DrainsInFlightApplies(t *testing.T) {
+	gate := &drainGate{}
+	if !gate.enter() {
+		t.Fatal("enter() on an open gate returned false")
+	}
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(released)
+		gate.leave()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	srv := &http.Server{Addr: "127.0.0.1:0", Handler: http.NewServeMux()}
+	if err := serve(ctx, gate, time.Second, srv); err != nil {
+		t.Fatalf("serve() unexpected error: %v", err)
+	}
+
+	select {
+	case <-released:
+	default:
+		t.Error("serve() returned before the in-flight apply finished")
+	}
+	if gate.enter() {
+		t.Error("enter() after shutdown returned true; want false")
+	}
+}
+
+func TestWriteTimeout_CoversRequestTimeout(t *testing.T) {
+	if got, want := writeTimeout(config.Config{}), DefaultRequestTimeout+provider.DefaultAPITimeout+writeTimeoutMargin; got != want {
+		t.Errorf("writeTimeout() with defaults = %s; want %s", got, want)
+	}
+	cfg := config.Config{RequestTimeout: 2 * time.Minute, ApiTimeout: 10 * time.Second}
+	if got, want := writeTimeout(cfg), 2*time.Minute+10*time.Second+writeTimeoutMargin; got != want {
+		t.Errorf("writeTimeout() = %s; want %s", got, want)
+	}
+}
+
+func TestWithTimeout(t *testing.T) {
+	var deadline time.Time
+	h := withTimeout(time.Minute, func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ = r.Context().Deadline()
+	})
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/records", nil))
+	if until := time.Until(deadline); until <= 0 || until > time.Minute {
+		t.Errorf("request deadline in %s; want within a minute", until)
+	}
+}
+
+func TestNewRegistry_Affixes(t *testing.T) {
+	tests := []struct {
+		cfg                    config.Config
+		wantPrefix, wantSuffix string
+	}{
+		{config.Config{}, registry.DefaultPrefix, ""},
+		{config.Config{TxtPrefix: "reg."}, "reg.", ""},
+		{config.Config{TxtSuffix: "-reg"}, "", "-reg"},
+	}
+	for _, tt := range tests {
+		reg := newRegistry(tt.cfg)
+		if err := reg.Validate(); err != nil {
+			t.Errorf("newRegistry(%+v).Validate() = %v; want nil", tt.cfg, err)
+		}
+		if reg.Prefix != tt.wantPrefix || reg.Suffix != tt.wantSuffix {
+			t.Errorf("newRegistry(%+v) affixes = %q, %q; want %q, %q", tt.cfg, reg.Prefix, reg.Suffix, tt.wantPrefix, tt.wantSuffix)
+		}
+	}
+}
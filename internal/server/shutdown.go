@@ -0,0 +1,114 @@
+// Copyright 2025- The sacloud/external-dns-sacloud-webhook authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sacloud/external-dns-sacloud-webhook/internal/logging"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests may drain after a
+// termination signal when no timeout is configured.
+const DefaultShutdownTimeout = 30 * time.Second
+
+// drainGate tracks in-flight POST /records requests and refuses new ones
+// once shutdown has started. The zero value is open.
+type drainGate struct {
+	mu       sync.Mutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// enter registers a new apply; it reports false once the gate is closed.
+func (g *drainGate) enter() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.inflight.Add(1)
+	return true
+}
+
+// leave marks an apply registered by enter as finished.
+func (g *drainGate) leave() {
+	g.inflight.Done()
+}
+
+// close refuses every later enter.
+func (g *drainGate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+}
+
+// wait blocks until every registered apply has left.
+func (g *drainGate) wait() {
+	g.inflight.Wait()
+}
+
+// serve runs the servers until one of them fails or ctx is done, then shuts
+// them down gracefully. New applies are refused right away; applies in
+// progress get up to timeout to finish, after which their request contexts
+// are cancelled so they abort before the next zone update.
+func serve(ctx context.Context, gate *drainGate, timeout time.Duration, servers ...*http.Server) error {
+	base, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv.BaseContext = func(net.Listener) context.Context { return base }
+		go func(srv *http.Server) {
+			slog.Info("starting HTTP server", "addr", srv.Addr)
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- err
+			}
+		}(srv)
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	slog.Info("shutdown requested, draining in-flight requests", "timeout", timeout)
+	gate.close()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("drain timeout reached, aborting remaining requests", "addr", srv.Addr, logging.KeyError, err)
+			abort()
+			if err := srv.Close(); err != nil {
+				slog.Error("failed to close HTTP server", "addr", srv.Addr, logging.KeyError, err)
+			}
+		}
+	}
+	gate.wait()
+	slog.Info("shutdown complete")
+	return nil
+}